@@ -1,5 +1,5 @@
 /*
-Copyright 2022-2023 Hewlett Packard Enterprise Development LP.
+Copyright 2022-2024 Hewlett Packard Enterprise Development LP.
 
 Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
@@ -17,9 +17,13 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
 	"runtime"
+	"strings"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
@@ -31,6 +35,7 @@ import (
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
 	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
 
 	controllers "github.com/DataWorkflowServices/dws-test-driver/internal/controller"
@@ -52,14 +57,102 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "submit" {
+		if err := submit(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, "submit:", err)
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	var metricsAddr string
 	var enableLeaderElection bool
 	var probeAddr string
+	var copyRoots string
+	var transferBandwidth string
+	var enableCrash bool
+	var statusLatency string
+	var populateComputes bool
+	var computeNodes string
+	var clientMountAgent bool
+	var clientMountSandbox string
+	var clientMountFailNodes string
+	var clientMountFailMounts string
+	var clientMountFailSeverity string
+	var storageNodes string
+	var storageDevices int
+	var storageDeviceCapacity string
+	var systemConfig string
+	var capacityFailSeverity string
+	var orphanGracePeriod time.Duration
+	var wlmID string
+	var wlmSlots int
+	var wlmQueueOrder string
+	var wlmJob string
+	var wlmJobScripts string
+	var wlmJobRoots string
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
 		"Enable leader election for controller manager. "+
 			"Enabling this will ensure there is only one active controller manager.")
+	flag.StringVar(&copyRoots, "copy-roots", "",
+		"Comma separated list of directories that the copy action may read from and write to. "+
+			"The copy action is disabled if no directories are given.")
+	flag.StringVar(&transferBandwidth, "transfer-bandwidth", "",
+		"Bytes per second shared fairly by the transfer actions in progress, such as '10GB'. "+
+			"The transfer action is disabled if no bandwidth is given.")
+	flag.BoolVar(&enableCrash, "enable-crash-action", false,
+		"Allow the crash action to terminate the controller manager.")
+	flag.StringVar(&statusLatency, "status-latency", "0s",
+		"Delay before writing driver status updates, either fixed (500ms) or picked at random from a range (100ms-2s). "+
+			"A latency argument on a directive takes precedence.")
+	flag.BoolVar(&populateComputes, "populate-computes", false,
+		"Fill the Computes resource of every workflow with tester directives in Proposal, "+
+			"rather than only those with a computes argument.")
+	flag.StringVar(&computeNodes, "compute-nodes", "",
+		"Hostlist of compute node names used to populate Computes resources, such as 'node[01-16]'. "+
+			"The compute nodes in the SystemConfiguration are used if no names are given.")
+	flag.BoolVar(&clientMountAgent, "clientmount-agent", false,
+		"Reconcile ClientMount resources the way the agent on a compute node would.")
+	flag.StringVar(&clientMountSandbox, "clientmount-sandbox", "",
+		"Directory under which the ClientMount agent creates the mount paths, in a subdirectory for each node. "+
+			"Mount paths are not created if no directory is given.")
+	flag.StringVar(&clientMountFailNodes, "clientmount-fail-nodes", "",
+		"Hostlist of nodes where the ClientMount agent fails every mount.")
+	flag.StringVar(&clientMountFailMounts, "clientmount-fail-mounts", "",
+		"Comma separated list of mount paths that the ClientMount agent fails on every node.")
+	flag.StringVar(&clientMountFailSeverity, "clientmount-fail-severity", "Major",
+		"Severity of the errors for mounts that the ClientMount agent fails: Minor, Major, or Fatal.")
+	flag.StringVar(&storageNodes, "storage-nodes", "",
+		"Hostlist of simulated storage nodes, such as 'rabbit-[0-3]'. A Storage resource is created for each node.")
+	flag.IntVar(&storageDevices, "storage-devices", 8, "Number of devices in each simulated storage node.")
+	flag.StringVar(&storageDeviceCapacity, "storage-device-capacity", "3.2TB",
+		"Capacity of each device in the simulated storage nodes.")
+	flag.StringVar(&systemConfig, "system-config", "",
+		"Topology used to create or update the default SystemConfiguration at startup, such as "+
+			"'4x16+8,ports=6000-6100,cooldown=60' for 4 storage nodes with 16 computes each and 8 external computes.")
+	flag.StringVar(&capacityFailSeverity, "capacity-fail-severity", "Major",
+		"Severity of the errors for storage that doesn't fit in the free capacity of the simulated storage nodes: "+
+			"Minor, Major, or Fatal.")
+	flag.DurationVar(&orphanGracePeriod, "orphan-grace-period", time.Minute,
+		"How long after a workflow is deleted to check for resources left with its labels. "+
+			"Zero disables the check.")
+	flag.StringVar(&wlmID, "wlm-id", "",
+		"Play the part of the WLM for workflows with this WLM ID, moving them through their states and deleting them "+
+			"after Teardown. The WLM is not simulated if no ID is given.")
+	flag.IntVar(&wlmSlots, "wlm-slots", 0,
+		"Number of queued workflows that the simulated WLM runs at once. Zero runs every queued workflow.")
+	flag.StringVar(&wlmQueueOrder, "wlm-queue-order", "fifo",
+		"Order in which the simulated WLM admits queued workflows: fifo or priority.")
+	flag.StringVar(&wlmJob, "wlm-job", "",
+		"Compute job that the simulated WLM runs between PreRun and PostRun: 'sleep:<duration>', 'script:<path>', "+
+			"or 'write:<path>:<size>'. No job is run if none is given.")
+	flag.StringVar(&wlmJobScripts, "wlm-job-scripts", "",
+		"Comma separated list of scripts that the compute jobs of the simulated WLM may run.")
+	flag.StringVar(&wlmJobRoots, "wlm-job-roots", "",
+		"Comma separated list of directories that the compute jobs of the simulated WLM may write to.")
 	opts := zapcr.Options{
 		Development: true,
 	}
@@ -71,6 +164,77 @@ func main() {
 	ctrl.SetLogger(zaplogger)
 
 	setupLog.Info("GOMAXPROCS", "value", runtime.GOMAXPROCS(0))
+
+	latency, err := controllers.ParseLatency(statusLatency)
+	if err != nil {
+		setupLog.Error(err, "invalid status latency")
+		os.Exit(1)
+	}
+
+	bandwidth := int64(0)
+	if transferBandwidth != "" {
+		if bandwidth, err = controllers.ParseCapacity(transferBandwidth); err != nil {
+			setupLog.Error(err, "invalid transfer bandwidth")
+			os.Exit(1)
+		}
+	}
+
+	computeNodeNames, err := controllers.ExpandHostlist(computeNodes)
+	if err != nil {
+		setupLog.Error(err, "invalid compute nodes")
+		os.Exit(1)
+	}
+
+	failNodeNames, err := controllers.ExpandHostlist(clientMountFailNodes)
+	if err != nil {
+		setupLog.Error(err, "invalid ClientMount fail nodes")
+		os.Exit(1)
+	}
+
+	failSeverity, err := controllers.ParseSeverity(clientMountFailSeverity)
+	if err != nil {
+		setupLog.Error(err, "invalid ClientMount fail severity")
+		os.Exit(1)
+	}
+
+	storageNodeNames, err := controllers.ExpandHostlist(storageNodes)
+	if err != nil {
+		setupLog.Error(err, "invalid storage nodes")
+		os.Exit(1)
+	}
+
+	deviceCapacity, err := controllers.ParseCapacity(storageDeviceCapacity)
+	if err != nil {
+		setupLog.Error(err, "invalid storage device capacity")
+		os.Exit(1)
+	}
+
+	capacitySeverity, err := controllers.ParseSeverity(capacityFailSeverity)
+	if err != nil {
+		setupLog.Error(err, "invalid capacity fail severity")
+		os.Exit(1)
+	}
+
+	queueOrder, err := controllers.ParseQueueOrder(wlmQueueOrder)
+	if err != nil {
+		setupLog.Error(err, "invalid WLM queue order")
+		os.Exit(1)
+	}
+
+	if err := controllers.ValidateJob(wlmJob); err != nil {
+		setupLog.Error(err, "invalid WLM job")
+		os.Exit(1)
+	}
+
+	var topology *controllers.SystemTopology
+	if systemConfig != "" {
+		topology, err = controllers.ParseSystemTopology(systemConfig)
+		if err != nil {
+			setupLog.Error(err, "invalid system config")
+			os.Exit(1)
+		}
+	}
+
 	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
 		Scheme:                 scheme,
 		Metrics:                metricsserver.Options{BindAddress: metricsAddr},
@@ -94,16 +258,98 @@ func main() {
 		os.Exit(1)
 	}
 
+	var orphans *controllers.OrphanChecker
+	if orphanGracePeriod > 0 {
+		orphans = controllers.NewOrphanChecker(mgr.GetClient(), ctrl.Log.WithName("controllers").WithName("Orphans"),
+			mgr.GetEventRecorderFor("dws-test-driver"), orphanGracePeriod)
+		if err := mgr.Add(orphans); err != nil {
+			setupLog.Error(err, "unable to add orphan checker")
+			os.Exit(1)
+		}
+	}
+
 	if err = (&controllers.WorkflowReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-		Log:    ctrl.Log.WithName("controllers").WithName("TestDriver"),
+		Client:            mgr.GetClient(),
+		Scheme:            mgr.GetScheme(),
+		Log:               ctrl.Log.WithName("controllers").WithName("TestDriver"),
+		CopyRoots:         splitList(copyRoots),
+		EnableCrash:       enableCrash,
+		StatusLatency:     latency,
+		PopulateComputes:  populateComputes,
+		ComputeNodes:      computeNodeNames,
+		CapacitySeverity:  capacitySeverity,
+		Orphans:           orphans,
+		TransferBandwidth: bandwidth,
 	}).SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "Workflow")
 		os.Exit(1)
 	}
+	if err = (&controllers.ServersReconciler{
+		Client:           mgr.GetClient(),
+		Scheme:           mgr.GetScheme(),
+		Log:              ctrl.Log.WithName("controllers").WithName("Servers"),
+		CapacitySeverity: capacitySeverity,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Servers")
+		os.Exit(1)
+	}
+	if clientMountAgent {
+		if err = (&controllers.ClientMountReconciler{
+			Client:       mgr.GetClient(),
+			Scheme:       mgr.GetScheme(),
+			Log:          ctrl.Log.WithName("controllers").WithName("ClientMount"),
+			SandboxRoot:  clientMountSandbox,
+			FailNodes:    failNodeNames,
+			FailMounts:   splitList(clientMountFailMounts),
+			FailSeverity: failSeverity,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "ClientMount")
+			os.Exit(1)
+		}
+	}
+	if len(storageNodeNames) > 0 {
+		if err = (&controllers.StorageReconciler{
+			Client:         mgr.GetClient(),
+			Scheme:         mgr.GetScheme(),
+			Log:            ctrl.Log.WithName("controllers").WithName("Storage"),
+			Nodes:          storageNodeNames,
+			Devices:        storageDevices,
+			DeviceCapacity: deviceCapacity,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Storage")
+			os.Exit(1)
+		}
+	}
+	if wlmID != "" {
+		if err = (&controllers.WLMReconciler{
+			Client:     mgr.GetClient(),
+			Scheme:     mgr.GetScheme(),
+			Log:        ctrl.Log.WithName("controllers").WithName("WLM"),
+			APIReader:  mgr.GetAPIReader(),
+			WLMID:      wlmID,
+			Slots:      wlmSlots,
+			QueueOrder: queueOrder,
+			Job:        wlmJob,
+			JobScripts: splitList(wlmJobScripts),
+			JobRoots:   splitList(wlmJobRoots),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "WLM")
+			os.Exit(1)
+		}
+	}
 	//+kubebuilder:scaffold:builder
 
+	if topology != nil {
+		err = mgr.Add(manager.RunnableFunc(func(ctx context.Context) error {
+			setupLog.Info("applying SystemConfiguration", "topology", systemConfig)
+			return controllers.ApplySystemConfiguration(ctx, mgr.GetClient(), topology)
+		}))
+		if err != nil {
+			setupLog.Error(err, "unable to apply SystemConfiguration")
+			os.Exit(1)
+		}
+	}
+
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
 		setupLog.Error(err, "unable to set up health check")
 		os.Exit(1)
@@ -119,3 +365,15 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// splitList splits a comma separated flag value into its non-empty elements.
+func splitList(value string) []string {
+	list := []string{}
+	for _, element := range strings.Split(value, ",") {
+		if element = strings.TrimSpace(element); element != "" {
+			list = append(list, element)
+		}
+	}
+
+	return list
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"github.com/ghodss/yaml"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	controllers "github.com/DataWorkflowServices/dws-test-driver/internal/controller"
+)
+
+// followInterval is how often a followed workflow is checked for changes
+const followInterval = time.Second
+
+// submit creates a Workflow from the #DW directives in a batch job script,
+// playing the part of the WLM when a job is submitted. The workflow can be
+// followed through its states until it finishes Teardown or is deleted.
+func submit(args []string) error {
+	var name string
+	var namespace string
+	var wlmID string
+	var jobID string
+	var userID uint
+	var groupID uint
+	var aliases string
+	var dryRun bool
+	var follow bool
+	var timeout time.Duration
+
+	flags := flag.NewFlagSet("submit", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s submit [flags] <job script>\n\n", os.Args[0])
+		fmt.Fprintf(flags.Output(), "Create a Workflow from the #DW directives in a job script, or '-' for standard input.\n\n")
+		flags.PrintDefaults()
+	}
+	flags.StringVar(&name, "name", "", "Name of the Workflow. Defaults to 'job-<job ID>'.")
+	flags.StringVar(&namespace, "namespace", "default", "Namespace of the Workflow.")
+	flags.StringVar(&wlmID, "wlm-id", "TD WLM", "WLM ID of the Workflow.")
+	flags.StringVar(&jobID, "job-id", "", "Job ID of the Workflow. Defaults to the current time in seconds.")
+	flags.UintVar(&userID, "user-id", uint(os.Getuid()), "User ID of the Workflow. Defaults to the current user.")
+	flags.UintVar(&groupID, "group-id", uint(os.Getgid()), "Group ID of the Workflow. Defaults to the current user's group.")
+	flags.StringVar(&aliases, "aliases", "",
+		"Comma separated list of directive prefixes, such as '#BB', that are read as #DW.")
+	flags.BoolVar(&dryRun, "dry-run", false, "Print the Workflow as YAML rather than creating it.")
+	flags.BoolVar(&follow, "follow", false,
+		"Print the state of the Workflow as it changes, until it finishes Teardown or is deleted.")
+	flags.DurationVar(&timeout, "timeout", 0, "How long to follow the Workflow. Zero follows it until it finishes.")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("expected a single job script")
+	}
+
+	script, err := readJobScript(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer script.Close()
+
+	directives, err := controllers.ParseJobScript(script, splitList(aliases))
+	if err != nil {
+		return fmt.Errorf("invalid job script '%s': %w", flags.Arg(0), err)
+	}
+
+	if jobID == "" {
+		jobID = strconv.FormatInt(time.Now().Unix(), 10)
+	}
+	if name == "" {
+		name = "job-" + strings.ToLower(jobID)
+	}
+
+	workflow := &dwsv1alpha2.Workflow{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: dwsv1alpha2.GroupVersion.String(),
+			Kind:       "Workflow",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+		},
+		Spec: dwsv1alpha2.WorkflowSpec{
+			DesiredState: dwsv1alpha2.StateProposal,
+			WLMID:        wlmID,
+			JobID:        intstr.Parse(jobID),
+			UserID:       uint32(userID),
+			GroupID:      uint32(groupID),
+			DWDirectives: directives,
+		},
+	}
+
+	if dryRun {
+		data, err := yaml.Marshal(workflow)
+		if err != nil {
+			return err
+		}
+
+		fmt.Print(string(data))
+		return nil
+	}
+
+	c, err := client.New(ctrl.GetConfigOrDie(), client.Options{Scheme: scheme})
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if err := c.Create(ctx, workflow); err != nil {
+		return err
+	}
+
+	fmt.Printf("Created Workflow %s/%s with %d directives\n", namespace, name, len(directives))
+
+	if !follow {
+		return nil
+	}
+
+	return followWorkflow(ctx, c, client.ObjectKeyFromObject(workflow))
+}
+
+// readJobScript opens the job script, with "-" for standard input
+func readJobScript(path string) (io.ReadCloser, error) {
+	if path == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+
+	return os.Open(path)
+}
+
+// followWorkflow prints the state, status, and message of a workflow each time
+// they change, until the workflow finishes Teardown or is deleted. Returns an
+// error if the workflow reported an error along the way.
+func followWorkflow(ctx context.Context, c client.Client, key client.ObjectKey) error {
+	ticker := time.NewTicker(followInterval)
+	defer ticker.Stop()
+
+	last := ""
+	failed := false
+	for {
+		workflow := &dwsv1alpha2.Workflow{}
+		if err := c.Get(ctx, key, workflow); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return err
+			}
+
+			fmt.Println("Workflow deleted")
+			break
+		}
+
+		status := workflow.Status
+		line := fmt.Sprintf("%s\t%s\tready=%t", status.State, status.Status, status.Ready)
+		if status.Message != "" {
+			line += "\t" + status.Message
+		}
+		if line != last {
+			fmt.Println(line)
+			last = line
+		}
+
+		failed = failed || status.Status == dwsv1alpha2.StatusError
+		if status.State == dwsv1alpha2.StateTeardown && status.Ready {
+			break
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if failed {
+		return errors.New("workflow reported an error")
+	}
+
+	return nil
+}
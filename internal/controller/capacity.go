@@ -0,0 +1,182 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// capacityLedger tracks the capacity of the storage nodes simulated by the
+// driver and how much of it the driver's allocations use. Storage that isn't
+// simulated by the driver has no capacity limit.
+type capacityLedger struct {
+	capacity  map[string]int64
+	allocated map[string]int64
+}
+
+// loadCapacityLedger builds the ledger from the Storage and Servers resources
+// of the driver. The allocations of the Servers resource with the excluded UID
+// are left out for that Servers resource to charge along with its new ones.
+func loadCapacityLedger(ctx context.Context, c client.Client, exclude types.UID) (*capacityLedger, error) {
+	ledger := &capacityLedger{
+		capacity:  map[string]int64{},
+		allocated: map[string]int64{},
+	}
+
+	storages := &dwsv1alpha2.StorageList{}
+	if err := c.List(ctx, storages, client.MatchingLabels{driverLabel: DRIVERID}); err != nil {
+		return nil, err
+	}
+
+	for _, storage := range storages.Items {
+		ledger.capacity[storage.Name] = storage.Status.Capacity
+	}
+
+	serversList := &dwsv1alpha2.ServersList{}
+	if err := c.List(ctx, serversList, client.MatchingLabels{driverLabel: DRIVERID}); err != nil {
+		return nil, err
+	}
+
+	for _, servers := range serversList.Items {
+		if servers.GetUID() == exclude || !servers.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+
+		ledger.add(&servers)
+	}
+
+	return ledger, nil
+}
+
+// add takes the capacity of the allocations that a Servers resource reports.
+// Each allocation set takes its allocation size for every allocation that the
+// spec asks for on a storage.
+func (l *capacityLedger) add(servers *dwsv1alpha2.Servers) {
+	for _, allocationSet := range servers.Status.AllocationSets {
+		for name, storage := range allocationSet.Storage {
+			l.allocated[name] += storage.AllocationSize * int64(allocationCount(servers, allocationSet.Label, name))
+		}
+	}
+}
+
+// hold charges the allocations that a Servers resource already reports. Returns
+// the storage where they no longer fit because the spec asks for more of them
+// than before. The allocations on that storage aren't charged, so that they
+// can be checked again like new ones.
+func (l *capacityLedger) hold(servers *dwsv1alpha2.Servers) map[string]bool {
+	held := &capacityLedger{allocated: map[string]int64{}}
+	held.add(servers)
+
+	overrun := map[string]bool{}
+	for storage, size := range held.allocated {
+		if free, limited := l.free(storage); limited && size > free {
+			overrun[storage] = true
+			continue
+		}
+
+		l.allocated[storage] += size
+	}
+
+	return overrun
+}
+
+// allocationCount returns the number of allocations that the spec of a Servers
+// resource asks for on a storage in an allocation set. The status only reports
+// the size of each allocation.
+func allocationCount(servers *dwsv1alpha2.Servers, label string, storage string) int {
+	for _, allocationSet := range servers.Spec.AllocationSets {
+		if allocationSet.Label != label {
+			continue
+		}
+
+		for _, allocation := range allocationSet.Storage {
+			if allocation.Name == storage && allocation.AllocationCount > 0 {
+				return allocation.AllocationCount
+			}
+		}
+	}
+
+	return 1
+}
+
+// free returns the unallocated capacity of a storage node, and false if the
+// storage node has no capacity limit
+func (l *capacityLedger) free(storage string) (int64, bool) {
+	capacity, found := l.capacity[storage]
+	if !found {
+		return 0, false
+	}
+
+	return capacity - l.allocated[storage], true
+}
+
+// totalFree returns the unallocated capacity of all the storage nodes, and
+// false if there are no storage nodes with a capacity limit
+func (l *capacityLedger) totalFree() (int64, bool) {
+	if len(l.capacity) == 0 {
+		return 0, false
+	}
+
+	total := int64(0)
+	for storage := range l.capacity {
+		if free, _ := l.free(storage); free > 0 {
+			total += free
+		}
+	}
+
+	return total, true
+}
+
+// allocate takes capacity from a storage node. Returns an error if the
+// allocation is larger than the free capacity, in which case nothing is taken.
+func (l *capacityLedger) allocate(storage string, size int64, severity dwsv1alpha2.ResourceErrorSeverity) *dwsv1alpha2.ResourceErrorInfo {
+	free, limited := l.free(storage)
+	if limited && size > free {
+		return insufficientCapacityError(storage, size, free, severity)
+	}
+
+	l.allocated[storage] += size
+	return nil
+}
+
+// insufficientCapacityError builds the error for an allocation that is larger
+// than the free capacity. An empty storage name refers to the capacity of all
+// the storage nodes.
+func insufficientCapacityError(storage string, requested int64, free int64, severity dwsv1alpha2.ResourceErrorSeverity) *dwsv1alpha2.ResourceErrorInfo {
+	if free < 0 {
+		free = 0
+	}
+
+	var resErr *dwsv1alpha2.ResourceErrorInfo
+	if storage == "" {
+		resErr = dwsv1alpha2.NewResourceError("insufficient capacity: requested %d bytes, %d bytes free", requested, free).
+			WithUserMessage("insufficient capacity for the requested storage")
+	} else {
+		resErr = dwsv1alpha2.NewResourceError("insufficient capacity on storage '%s': requested %d bytes, %d bytes free", storage, requested, free).
+			WithUserMessage("insufficient capacity on storage '%s'", storage)
+	}
+
+	if severity != "" {
+		resErr.Severity = severity
+	}
+
+	return resErr
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Capacity Test", func() {
+
+	var ledger *capacityLedger
+
+	BeforeEach(func() {
+		ledger = &capacityLedger{
+			capacity:  map[string]int64{"rabbit-0": 1000, "rabbit-1": 500},
+			allocated: map[string]int64{"rabbit-0": 400},
+		}
+	})
+
+	It("Reports the free capacity", func() {
+		free, limited := ledger.free("rabbit-0")
+		Expect(limited).To(BeTrue())
+		Expect(free).To(Equal(int64(600)))
+
+		total, limited := ledger.totalFree()
+		Expect(limited).To(BeTrue())
+		Expect(total).To(Equal(int64(1100)))
+	})
+
+	It("Takes capacity for allocations that fit", func() {
+		Expect(ledger.allocate("rabbit-0", 600, dwsv1alpha2.SeverityMajor)).To(BeNil())
+
+		free, _ := ledger.free("rabbit-0")
+		Expect(free).To(BeZero())
+	})
+
+	It("Fails allocations that don't fit", func() {
+		resErr := ledger.allocate("rabbit-1", 501, dwsv1alpha2.SeverityMajor)
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityMajor))
+		Expect(resErr.UserMessage).To(Equal("insufficient capacity on storage 'rabbit-1'"))
+		Expect(resErr.Error()).To(ContainSubstring("requested 501 bytes, 500 bytes free"))
+
+		free, _ := ledger.free("rabbit-1")
+		Expect(free).To(Equal(int64(500)))
+	})
+
+	It("Doesn't limit storage that isn't simulated", func() {
+		_, limited := ledger.free("other")
+		Expect(limited).To(BeFalse())
+		Expect(ledger.allocate("other", 1<<50, dwsv1alpha2.SeverityFatal)).To(BeNil())
+
+		empty := &capacityLedger{capacity: map[string]int64{}, allocated: map[string]int64{}}
+		_, limited = empty.totalFree()
+		Expect(limited).To(BeFalse())
+	})
+
+	It("Counts the least capacity a breakdown needs", func() {
+		breakdownStatus, resErr := breakdownStorage(map[string]string{"type": "lustre", "capacity": "100GB"})
+		Expect(resErr).To(BeNil())
+		Expect(requestedCapacity(breakdownStatus)).To(Equal(int64(100e9 + lustreMgtCapacity + lustreMdtCapacity)))
+	})
+
+	It("Keeps allocations that were already made", func() {
+		status := &dwsv1alpha2.ServersStatus{
+			AllocationSets: []dwsv1alpha2.ServersStatusAllocationSet{{
+				Label:   "ost",
+				Storage: map[string]dwsv1alpha2.ServersStatusStorage{"rabbit-0": {AllocationSize: 100}},
+			}},
+		}
+
+		Expect(isAllocated(status, "ost", "rabbit-0", 100)).To(BeTrue())
+		Expect(isAllocated(status, "ost", "rabbit-0", 200)).To(BeFalse())
+		Expect(isAllocated(status, "mdt", "rabbit-0", 100)).To(BeFalse())
+	})
+	It("Charges every allocation on a storage", func() {
+		servers := &dwsv1alpha2.Servers{
+			Spec: dwsv1alpha2.ServersSpec{
+				AllocationSets: []dwsv1alpha2.ServersSpecAllocationSet{{
+					Label:          "xfs",
+					AllocationSize: 100,
+					Storage:        []dwsv1alpha2.ServersSpecStorage{{Name: "rabbit-1", AllocationCount: 3}},
+				}},
+			},
+			Status: dwsv1alpha2.ServersStatus{
+				AllocationSets: []dwsv1alpha2.ServersStatusAllocationSet{{
+					Label:   "xfs",
+					Storage: map[string]dwsv1alpha2.ServersStatusStorage{"rabbit-1": {AllocationSize: 100}},
+				}},
+			},
+		}
+
+		Expect(allocationCount(servers, "xfs", "rabbit-1")).To(Equal(3))
+		Expect(allocationCount(servers, "ost", "rabbit-1")).To(Equal(1))
+
+		ledger.add(servers)
+		free, _ := ledger.free("rabbit-1")
+		Expect(free).To(Equal(int64(200)))
+
+		// Three more allocations of 100 bytes don't fit in what's left
+		Expect(ledger.allocate("rabbit-1", 3*100, dwsv1alpha2.SeverityMajor)).ToNot(BeNil())
+	})
+})
@@ -0,0 +1,345 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"github.com/DataWorkflowServices/dws/utils/updater"
+	"github.com/go-logr/logr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// clientMountFinalizer keeps a ClientMount around until the agent has
+// unmounted it
+const clientMountFinalizer = testerDomain + "clientmount"
+
+// ClientMountReconciler reconciles ClientMount resources the way the agent on
+// a compute node would. Mounts are simulated, optionally by creating the mount
+// paths under a sandbox directory.
+type ClientMountReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// SandboxRoot is the directory under which the mount paths are created,
+	// in a subdirectory for each node. Mount paths are not created when this
+	// is empty.
+	SandboxRoot string
+
+	// FailNodes are the nodes where every mount fails
+	FailNodes []string
+
+	// FailMounts are the mount paths that fail on every node
+	FailMounts []string
+
+	// FailSeverity is the severity of the errors for failed mounts
+	FailSeverity dwsv1alpha2.ResourceErrorSeverity
+}
+
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=clientmounts,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=clientmounts/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=workflows,verbs=get;list;watch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=servers,verbs=get;list;watch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=storages,verbs=get;list;watch
+
+// Reconcile moves each mount of a ClientMount to its desired state, unless
+// the node or the mount is configured to fail or the workflow's storage is on
+// an unhealthy storage node. Only the ClientMounts of workflows with tester
+// directives are reconciled.
+func (r *ClientMountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (res ctrl.Result, err error) {
+	log := r.Log.WithValues("ClientMount", req.NamespacedName)
+
+	clientMount := &dwsv1alpha2.ClientMount{}
+	if err := r.Get(ctx, req.NamespacedName, clientMount); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	// Unmount everything before letting the ClientMount go
+	if !clientMount.GetDeletionTimestamp().IsZero() {
+		if !controllerutil.ContainsFinalizer(clientMount, clientMountFinalizer) {
+			return ctrl.Result{}, nil
+		}
+
+		for _, mount := range clientMount.Spec.Mounts {
+			if err := r.unmount(clientMount.Spec.Node, mount); err != nil {
+				return ctrl.Result{}, err
+			}
+		}
+
+		controllerutil.RemoveFinalizer(clientMount, clientMountFinalizer)
+		if err := r.Update(ctx, clientMount); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+
+		log.Info("Removed finalizer")
+		return ctrl.Result{}, nil
+	}
+
+	if !controllerutil.ContainsFinalizer(clientMount, clientMountFinalizer) {
+		// Mounts are only simulated for the workflows with tester directives.
+		// The agents of the other drivers mount the rest.
+		workflow, err := r.mountWorkflow(ctx, clientMount)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+
+		if workflow == nil || !hasTesterDirectives(workflow) {
+			return ctrl.Result{}, nil
+		}
+
+		controllerutil.AddFinalizer(clientMount, clientMountFinalizer)
+		if err := r.Update(ctx, clientMount); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	statusUpdater := updater.NewStatusUpdater[*dwsv1alpha2.ClientMountStatus](clientMount)
+	defer func() { err = statusUpdater.CloseWithStatusUpdate(ctx, r.Client.Status(), err) }()
+
+	// Nothing is mounted until the mounts succeed
+	if len(clientMount.Status.Mounts) != len(clientMount.Spec.Mounts) {
+		clientMount.Status.Mounts = make([]dwsv1alpha2.ClientMountInfoStatus, len(clientMount.Spec.Mounts))
+		for i := range clientMount.Status.Mounts {
+			clientMount.Status.Mounts[i].State = dwsv1alpha2.ClientMountStateUnmounted
+		}
+	}
+
+	clientMount.Status.Error = nil
+	desiredState := clientMount.Spec.DesiredState
+
+	// Unmounting is always allowed so that the workflow can be torn down
+	var failure *dwsv1alpha2.ResourceErrorInfo
+	if desiredState == dwsv1alpha2.ClientMountStateMounted {
+		if failure, err = r.storageFailure(ctx, clientMount); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	for i, mount := range clientMount.Spec.Mounts {
+		if failure != nil {
+			log.Info("Failing mount for storage failure", "node", clientMount.Spec.Node, "path", mount.MountPath, "error", failure.Error())
+			clientMount.Status.Mounts[i].Ready = false
+			clientMount.Status.Error = failure
+			continue
+		}
+
+		if resErr := r.mountFailure(clientMount.Spec.Node, mount); resErr != nil {
+			log.Info("Failing mount", "node", clientMount.Spec.Node, "path", mount.MountPath, "error", resErr.Error())
+			clientMount.Status.Mounts[i].Ready = false
+			clientMount.Status.Error = resErr
+			continue
+		}
+
+		if clientMount.Status.Mounts[i].State == desiredState && clientMount.Status.Mounts[i].Ready {
+			continue
+		}
+
+		var mountErr error
+		switch desiredState {
+		case dwsv1alpha2.ClientMountStateMounted:
+			mountErr = r.mount(clientMount.Spec.Node, mount)
+		case dwsv1alpha2.ClientMountStateUnmounted:
+			mountErr = r.unmount(clientMount.Spec.Node, mount)
+		default:
+			mountErr = fmt.Errorf("unsupported desired state '%s'", desiredState)
+		}
+
+		if mountErr != nil {
+			clientMount.Status.Mounts[i].Ready = false
+			clientMount.Status.Error = dwsv1alpha2.NewResourceError("could not change mount '%s' to %s", mount.MountPath, desiredState).
+				WithError(mountErr).WithMajor()
+			continue
+		}
+
+		log.Info("Changed mount", "node", clientMount.Spec.Node, "path", mount.MountPath, "state", desiredState)
+		clientMount.Status.Mounts[i].State = desiredState
+		clientMount.Status.Mounts[i].Ready = true
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// mountFailure returns the error for a mount on a node that is configured to
+// fail, or nil if the mount should succeed
+func (r *ClientMountReconciler) mountFailure(node string, mount dwsv1alpha2.ClientMountInfo) *dwsv1alpha2.ResourceErrorInfo {
+	var resErr *dwsv1alpha2.ResourceErrorInfo
+
+	if containsString(r.FailNodes, node) {
+		resErr = dwsv1alpha2.NewResourceError("simulated mount failure on node '%s'", node)
+	} else if containsString(r.FailMounts, mount.MountPath) {
+		resErr = dwsv1alpha2.NewResourceError("simulated failure of mount '%s' on node '%s'", mount.MountPath, node)
+	} else {
+		return nil
+	}
+
+	if r.FailSeverity != "" {
+		resErr.Severity = r.FailSeverity
+	}
+
+	return resErr
+}
+
+// storageFailure returns the error for the unhealthy storage nodes that hold
+// the storage of the ClientMount's workflow, or nil if they're all healthy or
+// the ClientMount doesn't belong to a workflow
+func (r *ClientMountReconciler) storageFailure(ctx context.Context, clientMount *dwsv1alpha2.ClientMount) (*dwsv1alpha2.ResourceErrorInfo, error) {
+	workflow, err := r.mountWorkflow(ctx, clientMount)
+	if err != nil || workflow == nil {
+		return nil, err
+	}
+
+	return storageFailure(ctx, r.Client, workflow)
+}
+
+// mountWorkflow returns the workflow named by the workflow labels of the
+// ClientMount, or nil if the ClientMount doesn't belong to a workflow or the
+// workflow is gone
+func (r *ClientMountReconciler) mountWorkflow(ctx context.Context, clientMount *dwsv1alpha2.ClientMount) (*dwsv1alpha2.Workflow, error) {
+	labels := clientMount.GetLabels()
+	name, found := labels[dwsv1alpha2.WorkflowNameLabel]
+	if !found {
+		return nil, nil
+	}
+
+	workflow := &dwsv1alpha2.Workflow{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: labels[dwsv1alpha2.WorkflowNamespaceLabel]}, workflow); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	return workflow, nil
+}
+
+// isWorkflowMount returns true if the ClientMount belongs to a workflow. Only
+// the mounts of workflows can belong to the driver.
+func isWorkflowMount(object client.Object) bool {
+	_, found := object.GetLabels()[dwsv1alpha2.WorkflowNameLabel]
+	return found
+}
+
+// storageMapFunc maps a change to a simulated storage node to every
+// ClientMount, since any of them may have storage on the node
+func (r *ClientMountReconciler) storageMapFunc(ctx context.Context, object client.Object) []reconcile.Request {
+	clientMounts := &dwsv1alpha2.ClientMountList{}
+	if err := r.List(ctx, clientMounts); err != nil {
+		r.Log.Error(err, "Could not list ClientMounts")
+		return []reconcile.Request{}
+	}
+
+	requests := []reconcile.Request{}
+	for _, clientMount := range clientMounts.Items {
+		if !isWorkflowMount(&clientMount) {
+			continue
+		}
+
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&clientMount)})
+	}
+
+	return requests
+}
+
+// containsString returns true if the list contains the value
+func containsString(list []string, value string) bool {
+	for _, element := range list {
+		if element == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sandboxPath returns the path in the sandbox for a mount path on a node
+func sandboxPath(root string, node string, mountPath string) (string, error) {
+	nodeRoot := filepath.Join(root, node)
+	path := filepath.Join(nodeRoot, mountPath)
+
+	if filepath.Dir(nodeRoot) != filepath.Clean(root) || !withinRoots(path, []string{nodeRoot}) {
+		return "", fmt.Errorf("mount path '%s' on node '%s' is outside the sandbox", mountPath, node)
+	}
+
+	return path, nil
+}
+
+// mount creates the mount path in the sandbox
+func (r *ClientMountReconciler) mount(node string, mount dwsv1alpha2.ClientMountInfo) error {
+	if r.SandboxRoot == "" {
+		return nil
+	}
+
+	path, err := sandboxPath(r.SandboxRoot, node, mount.MountPath)
+	if err != nil {
+		return err
+	}
+
+	if mount.TargetType != "file" {
+		return os.MkdirAll(path, 0755)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// unmount removes the mount path and everything written to it from the sandbox
+func (r *ClientMountReconciler) unmount(node string, mount dwsv1alpha2.ClientMountInfo) error {
+	if r.SandboxRoot == "" {
+		return nil
+	}
+
+	path, err := sandboxPath(r.SandboxRoot, node, mount.MountPath)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ClientMountReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&dwsv1alpha2.ClientMount{}, builder.WithPredicates(predicate.NewPredicateFuncs(isWorkflowMount))).
+		Watches(&dwsv1alpha2.Storage{}, handler.EnqueueRequestsFromMapFunc(r.storageMapFunc),
+			builder.WithPredicates(predicate.NewPredicateFuncs(isDriverResource))).
+		Complete(r)
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("ClientMount Controller Test", func() {
+
+	var r *ClientMountReconciler
+
+	BeforeEach(func() {
+		r = &ClientMountReconciler{
+			SandboxRoot:  GinkgoT().TempDir(),
+			FailNodes:    []string{"node2"},
+			FailMounts:   []string{"/mnt/bad"},
+			FailSeverity: dwsv1alpha2.SeverityFatal,
+		}
+	})
+
+	It("Mounts and unmounts in the sandbox", func() {
+		mount := dwsv1alpha2.ClientMountInfo{MountPath: "/mnt/scratch", TargetType: "directory"}
+		path := filepath.Join(r.SandboxRoot, "node1", "mnt", "scratch")
+
+		Expect(r.mount("node1", mount)).To(Succeed())
+		Expect(path).To(BeADirectory())
+
+		Expect(os.WriteFile(filepath.Join(path, "data"), []byte("data"), 0644)).To(Succeed())
+
+		Expect(r.unmount("node1", mount)).To(Succeed())
+		Expect(path).ToNot(BeAnExistingFile())
+	})
+
+	It("Mounts file targets as files", func() {
+		mount := dwsv1alpha2.ClientMountInfo{MountPath: "/mnt/block", TargetType: "file"}
+
+		Expect(r.mount("node1", mount)).To(Succeed())
+		Expect(filepath.Join(r.SandboxRoot, "node1", "mnt", "block")).To(BeARegularFile())
+	})
+
+	DescribeTable("Rejects paths outside the sandbox",
+		func(node string, mountPath string) {
+			_, err := sandboxPath(r.SandboxRoot, node, mountPath)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("with a node that escapes", "..", "/mnt"),
+		Entry("with a node that names a subdirectory", "node1/mnt", "/scratch"),
+		Entry("with a mount path that escapes", "node1", "/../../mnt"),
+	)
+
+	DescribeTable("Fails configured nodes and mounts",
+		func(node string, mountPath string, fails bool) {
+			resErr := r.mountFailure(node, dwsv1alpha2.ClientMountInfo{MountPath: mountPath})
+			if !fails {
+				Expect(resErr).To(BeNil())
+				return
+			}
+
+			Expect(resErr).ToNot(BeNil())
+			Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+		},
+		Entry("with a healthy node and mount", "node1", "/mnt/scratch", false),
+		Entry("with a failed node", "node2", "/mnt/scratch", true),
+		Entry("with a failed mount", "node1", "/mnt/bad", true),
+	)
+})
+
+var _ = Describe("ClientMount Reconciler Test", func() {
+
+	var (
+		r        *ClientMountReconciler
+		workflow *dwsv1alpha2.Workflow
+	)
+
+	BeforeEach(func() {
+		r = &ClientMountReconciler{
+			Client:       k8sClient,
+			Log:          ctrl.Log.WithName("controllers").WithName("test-clientmount"),
+			SandboxRoot:  GinkgoT().TempDir(),
+			FailNodes:    []string{"node2"},
+			FailSeverity: dwsv1alpha2.SeverityMajor,
+		}
+
+		workflow = &dwsv1alpha2.Workflow{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "clientmount-" + uuid.NewString()[0:8],
+				Namespace: corev1.NamespaceDefault,
+			},
+			Spec: dwsv1alpha2.WorkflowSpec{
+				DesiredState: dwsv1alpha2.StateProposal,
+				WLMID:        "test",
+				JobID:        intstr.FromString("wlm job 442"),
+				DWDirectives: []string{"#DW PreRun action=wait"},
+			},
+		}
+		Expect(k8sClient.Create(context.TODO(), workflow)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(k8sClient.Delete(context.TODO(), workflow)).To(Succeed())
+		})
+
+		Eventually(func(g Gomega) bool {
+			g.Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(workflow), workflow)).To(Succeed())
+			return hasTesterDirectives(workflow)
+		}).Should(BeTrue())
+	})
+
+	// createClientMount makes a ClientMount for the node, labeled for the
+	// workflow unless it's nil
+	createClientMount := func(node string, workflow *dwsv1alpha2.Workflow) *dwsv1alpha2.ClientMount {
+		clientMount := &dwsv1alpha2.ClientMount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "clientmount-" + uuid.NewString()[0:8],
+				Namespace: corev1.NamespaceDefault,
+			},
+			Spec: dwsv1alpha2.ClientMountSpec{
+				Node:         node,
+				DesiredState: dwsv1alpha2.ClientMountStateMounted,
+				Mounts: []dwsv1alpha2.ClientMountInfo{{
+					MountPath:  "/mnt/scratch",
+					Device:     dwsv1alpha2.ClientMountDevice{Type: dwsv1alpha2.ClientMountDeviceTypeReference},
+					Type:       "none",
+					TargetType: "directory",
+				}},
+			},
+		}
+
+		if workflow != nil {
+			dwsv1alpha2.AddWorkflowLabels(clientMount, workflow)
+		}
+
+		Expect(k8sClient.Create(context.TODO(), clientMount)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(client.IgnoreNotFound(k8sClient.Delete(context.TODO(), clientMount))).To(Succeed())
+			Eventually(func() error {
+				_, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(clientMount)})
+				Expect(err).ToNot(HaveOccurred())
+				return k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(clientMount), clientMount)
+			}).ShouldNot(Succeed())
+		})
+
+		return clientMount
+	}
+
+	// reconcile runs the reconciler on the ClientMount and reads it back
+	reconcile := func(clientMount *dwsv1alpha2.ClientMount) {
+		_, err := r.Reconcile(context.TODO(), ctrl.Request{NamespacedName: client.ObjectKeyFromObject(clientMount)})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(clientMount), clientMount)).To(Succeed())
+	}
+
+	It("Mounts and unmounts the mounts of a workflow with tester directives", func() {
+		clientMount := createClientMount("node1", workflow)
+		path := filepath.Join(r.SandboxRoot, "node1", "mnt", "scratch")
+
+		// The finalizer is added first
+		reconcile(clientMount)
+		Expect(controllerutil.ContainsFinalizer(clientMount, clientMountFinalizer)).To(BeTrue())
+
+		reconcile(clientMount)
+		Expect(clientMount.Status.Error).To(BeNil())
+		Expect(clientMount.Status.Mounts).To(Equal([]dwsv1alpha2.ClientMountInfoStatus{
+			{State: dwsv1alpha2.ClientMountStateMounted, Ready: true},
+		}))
+		Expect(path).To(BeADirectory())
+
+		clientMount.Spec.DesiredState = dwsv1alpha2.ClientMountStateUnmounted
+		Expect(k8sClient.Update(context.TODO(), clientMount)).To(Succeed())
+
+		reconcile(clientMount)
+		Expect(clientMount.Status.Error).To(BeNil())
+		Expect(clientMount.Status.Mounts).To(Equal([]dwsv1alpha2.ClientMountInfoStatus{
+			{State: dwsv1alpha2.ClientMountStateUnmounted, Ready: true},
+		}))
+		Expect(path).ToNot(BeAnExistingFile())
+	})
+
+	It("Fails the mounts on the configured nodes", func() {
+		clientMount := createClientMount("node2", workflow)
+
+		reconcile(clientMount)
+		reconcile(clientMount)
+		Expect(clientMount.Status.Mounts).To(HaveLen(1))
+		Expect(clientMount.Status.Mounts[0].Ready).To(BeFalse())
+		Expect(clientMount.Status.Mounts[0].State).To(Equal(dwsv1alpha2.ClientMountStateUnmounted))
+		Expect(clientMount.Status.Error).ToNot(BeNil())
+		Expect(clientMount.Status.Error.Severity).To(Equal(dwsv1alpha2.SeverityMajor))
+		Expect(clientMount.Status.Error.Error()).To(ContainSubstring("node2"))
+	})
+
+	It("Leaves the mounts of other drivers alone", func() {
+		clientMount := createClientMount("node1", nil)
+
+		Expect(isWorkflowMount(clientMount)).To(BeFalse())
+
+		reconcile(clientMount)
+		reconcile(clientMount)
+		Expect(controllerutil.ContainsFinalizer(clientMount, clientMountFinalizer)).To(BeFalse())
+		Expect(clientMount.Status.Mounts).To(BeEmpty())
+	})
+})
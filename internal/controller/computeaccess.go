@@ -0,0 +1,163 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"sort"
+	"strings"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// breakdownForServers returns the DirectiveBreakdown whose storage constraints
+// refer to a Servers resource, or nil if there isn't one
+func breakdownForServers(ctx context.Context, c client.Client, servers *dwsv1alpha2.Servers) (*dwsv1alpha2.DirectiveBreakdown, error) {
+	breakdowns := &dwsv1alpha2.DirectiveBreakdownList{}
+	if err := c.List(ctx, breakdowns, client.InNamespace(servers.Namespace), client.MatchingLabels{driverLabel: DRIVERID}); err != nil {
+		return nil, err
+	}
+
+	for i := range breakdowns.Items {
+		breakdown := &breakdowns.Items[i]
+		if breakdown.Status.Storage != nil && breakdown.Status.Storage.Reference.Name == servers.Name {
+			return breakdown, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// serversStorageNodes returns the storage nodes that hold the allocations in
+// a Servers resource
+func serversStorageNodes(servers *dwsv1alpha2.Servers) []string {
+	found := map[string]bool{}
+	nodes := []string{}
+	for _, allocationSet := range servers.Status.AllocationSets {
+		for node := range allocationSet.Storage {
+			if !found[node] {
+				found[node] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	sort.Strings(nodes)
+	return nodes
+}
+
+// computeAccessError checks that every compute node can reach the storage
+// nodes, as described by the SystemConfiguration. A physical location needs
+// each compute node to be attached to one of the storage nodes, while a
+// network location only needs it to be a compute node of the system. Returns
+// a WLM error naming the compute nodes without a path, or nil if they all
+// have one.
+func computeAccessError(systemConfiguration *dwsv1alpha2.SystemConfiguration, locationType dwsv1alpha2.ComputeLocationType, storageNodes []string, computes []string) *dwsv1alpha2.ResourceErrorInfo {
+	reachable := map[string]bool{}
+
+	if locationType == dwsv1alpha2.ComputeLocationPhysical {
+		for _, storageNode := range systemConfiguration.Spec.StorageNodes {
+			if !containsString(storageNodes, storageNode.Name) {
+				continue
+			}
+
+			for _, compute := range storageNode.ComputesAccess {
+				reachable[compute.Name] = true
+			}
+		}
+	} else {
+		for _, name := range systemConfiguration.Computes() {
+			reachable[*name] = true
+		}
+		for _, name := range systemConfiguration.ComputesExternal() {
+			reachable[*name] = true
+		}
+	}
+
+	unreachable := []string{}
+	for _, compute := range computes {
+		if !reachable[compute] {
+			unreachable = append(unreachable, compute)
+		}
+	}
+
+	if len(unreachable) == 0 {
+		return nil
+	}
+
+	return dwsv1alpha2.NewResourceError("compute nodes %s have no %s path to storage nodes %s",
+		strings.Join(unreachable, ","), locationType, strings.Join(storageNodes, ",")).
+		WithUserMessage("compute nodes assigned to the job can't reach its storage").WithWLM().WithFatal()
+}
+
+// computeAccess checks that the compute nodes that the WLM assigned to the
+// workflow can reach the storage nodes holding the allocations in a Servers
+// resource. Returns the error for compute nodes without a path, or nil if
+// there are no compute nodes to check.
+func (r *WorkflowReconciler) computeAccess(ctx context.Context, workflow *dwsv1alpha2.Workflow, servers *dwsv1alpha2.Servers) (*dwsv1alpha2.ResourceErrorInfo, error) {
+	if workflow.Status.Computes.Name == "" {
+		return nil, nil
+	}
+
+	computes := &dwsv1alpha2.Computes{}
+	if err := r.Get(ctx, types.NamespacedName{Name: workflow.Status.Computes.Name, Namespace: workflow.Status.Computes.Namespace}, computes); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	if len(computes.Data) == 0 {
+		return nil, nil
+	}
+
+	breakdown, err := breakdownForServers(ctx, r.Client, servers)
+	if err != nil || breakdown == nil || breakdown.Status.Compute == nil {
+		return nil, err
+	}
+
+	systemConfiguration := &dwsv1alpha2.SystemConfiguration{}
+	if err := r.Get(ctx, systemConfigurationName, systemConfiguration); err != nil {
+		if apierrors.IsNotFound(err) {
+			return dwsv1alpha2.NewResourceError("could not get SystemConfiguration %v", systemConfigurationName).
+				WithError(err).WithMajor(), nil
+		}
+
+		return nil, err
+	}
+
+	names := []string{}
+	for _, compute := range computes.Data {
+		names = append(names, compute.Name)
+	}
+
+	storageNodes := serversStorageNodes(servers)
+	for _, location := range breakdown.Status.Compute.Constraints.Location {
+		for _, access := range location.Access {
+			// Best effort constraints are only a preference of the WLM
+			if access.Priority != dwsv1alpha2.ComputeLocationPriorityMandatory {
+				continue
+			}
+
+			if resErr := computeAccessError(systemConfiguration, access.Type, storageNodes, names); resErr != nil {
+				return resErr, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Compute Access Test", func() {
+
+	var systemConfiguration *dwsv1alpha2.SystemConfiguration
+
+	BeforeEach(func() {
+		topology, err := ParseSystemTopology("2x2+1")
+		Expect(err).ToNot(HaveOccurred())
+
+		systemConfiguration = &dwsv1alpha2.SystemConfiguration{Spec: topology.SystemConfigurationSpec()}
+	})
+
+	It("Accepts computes attached to the storage", func() {
+		Expect(computeAccessError(systemConfiguration, dwsv1alpha2.ComputeLocationPhysical,
+			[]string{"rabbit-1"}, []string{"compute-002", "compute-003"})).To(BeNil())
+	})
+
+	It("Rejects computes that aren't attached to the storage", func() {
+		resErr := computeAccessError(systemConfiguration, dwsv1alpha2.ComputeLocationPhysical,
+			[]string{"rabbit-1"}, []string{"compute-000", "compute-002", "external-000"})
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Type).To(Equal(dwsv1alpha2.TypeWLM))
+		Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+		Expect(resErr.Error()).To(ContainSubstring("compute nodes compute-000,external-000 have no physical path to storage nodes rabbit-1"))
+	})
+
+	It("Accepts any compute of the system over the network", func() {
+		Expect(computeAccessError(systemConfiguration, dwsv1alpha2.ComputeLocationNetwork,
+			[]string{"rabbit-1"}, []string{"compute-000", "external-000"})).To(BeNil())
+
+		resErr := computeAccessError(systemConfiguration, dwsv1alpha2.ComputeLocationNetwork,
+			[]string{"rabbit-1"}, []string{"elsewhere"})
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Error()).To(ContainSubstring("compute nodes elsewhere have no network path"))
+	})
+
+	It("Lists the storage nodes of the allocations", func() {
+		servers := &dwsv1alpha2.Servers{
+			Status: dwsv1alpha2.ServersStatus{
+				AllocationSets: []dwsv1alpha2.ServersStatusAllocationSet{
+					{Label: "mdt", Storage: map[string]dwsv1alpha2.ServersStatusStorage{"rabbit-1": {}, "rabbit-0": {}}},
+					{Label: "ost", Storage: map[string]dwsv1alpha2.ServersStatusStorage{"rabbit-1": {}}},
+				},
+			},
+		}
+
+		Expect(serversStorageNodes(servers)).To(Equal([]string{"rabbit-0", "rabbit-1"}))
+	})
+})
@@ -0,0 +1,119 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// systemConfigurationName is the name of the SystemConfiguration resource that
+// describes the system
+var systemConfigurationName = types.NamespacedName{
+	Name:      "default",
+	Namespace: corev1.NamespaceDefault,
+}
+
+// assignsComputes returns true if the driver plays the part of the WLM by
+// filling the Computes resource for a directive, either because the directive
+// names the computes or because the driver populates the Computes of every
+// workflow
+func (r *WorkflowReconciler) assignsComputes(args map[string]string) bool {
+	_, found := args["computes"]
+	return found || r.PopulateComputes
+}
+
+// populateComputes fills the Computes resource of the workflow with compute
+// node names, playing the part of the WLM. The names come from the computes
+// argument of the directive if present, then from the driver's list of
+// compute nodes, and finally from the compute nodes in the SystemConfiguration.
+// A Computes resource that already has data is left alone. Returns true once
+// the Computes resource has data, or false if DWS hasn't created it yet.
+func (r *WorkflowReconciler) populateComputes(ctx context.Context, workflow *dwsv1alpha2.Workflow, args map[string]string) (bool, error) {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow))
+
+	if workflow.Status.Computes.Name == "" {
+		return false, nil
+	}
+
+	computes := &dwsv1alpha2.Computes{}
+	if err := r.Get(ctx, types.NamespacedName{Name: workflow.Status.Computes.Name, Namespace: workflow.Status.Computes.Namespace}, computes); err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+
+	if len(computes.Data) > 0 {
+		return true, nil
+	}
+
+	names, err := r.computeNames(ctx, args)
+	if err != nil {
+		return false, err
+	}
+
+	if len(names) == 0 {
+		return false, dwsv1alpha2.NewResourceError("no compute node names available").
+			WithUserMessage("no compute nodes to assign to the job").WithWLM().WithFatal()
+	}
+
+	for _, name := range names {
+		computes.Data = append(computes.Data, dwsv1alpha2.ComputesData{Name: name})
+	}
+
+	log.Info("Populating Computes", "count", len(names))
+	if err := r.Update(ctx, computes); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// computeNames returns the compute node names to use for a workflow
+func (r *WorkflowReconciler) computeNames(ctx context.Context, args map[string]string) ([]string, error) {
+	if hostlist, found := args["computes"]; found {
+		names, err := ExpandHostlist(hostlist)
+		if err != nil {
+			return nil, dwsv1alpha2.NewResourceError("").WithError(err).
+				WithUserMessage("invalid 'computes' argument '%s'", hostlist).WithUser().WithFatal()
+		}
+
+		return names, nil
+	}
+
+	if len(r.ComputeNodes) > 0 {
+		return r.ComputeNodes, nil
+	}
+
+	systemConfiguration := &dwsv1alpha2.SystemConfiguration{}
+	if err := r.Get(ctx, systemConfigurationName, systemConfiguration); err != nil {
+		return nil, dwsv1alpha2.NewResourceError("could not get SystemConfiguration %v", systemConfigurationName).
+			WithError(err).WithMajor()
+	}
+
+	names := []string{}
+	for _, name := range systemConfiguration.Computes() {
+		names = append(names, *name)
+	}
+	for _, name := range systemConfiguration.ComputesExternal() {
+		names = append(names, *name)
+	}
+
+	return names, nil
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Computes Test", func() {
+
+	var (
+		r        *WorkflowReconciler
+		workflow *dwsv1alpha2.Workflow
+		computes *dwsv1alpha2.Computes
+	)
+
+	BeforeEach(func() {
+		id := uuid.NewString()[0:8]
+
+		// Each spec looks up its own SystemConfiguration
+		sysconfigName := systemConfigurationName
+		systemConfigurationName = types.NamespacedName{Name: "computes-" + id, Namespace: corev1.NamespaceDefault}
+		DeferCleanup(func() { systemConfigurationName = sysconfigName })
+
+		r = &WorkflowReconciler{
+			Client: k8sClient,
+			Log:    ctrl.Log.WithName("controllers").WithName("test-computes"),
+		}
+
+		computes = &dwsv1alpha2.Computes{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "computes-" + id,
+				Namespace: corev1.NamespaceDefault,
+			},
+		}
+
+		workflow = &dwsv1alpha2.Workflow{}
+		workflow.Status.Computes = corev1.ObjectReference{Name: computes.Name, Namespace: computes.Namespace}
+	})
+
+	createComputes := func() {
+		Expect(k8sClient.Create(context.TODO(), computes)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(k8sClient.Delete(context.TODO(), computes)).To(Succeed())
+		})
+	}
+
+	createSystemConfiguration := func(topology string) {
+		t, err := ParseSystemTopology(topology)
+		Expect(err).ToNot(HaveOccurred())
+
+		sysconfig := &dwsv1alpha2.SystemConfiguration{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      systemConfigurationName.Name,
+				Namespace: systemConfigurationName.Namespace,
+			},
+			Spec: t.SystemConfigurationSpec(),
+		}
+		Expect(k8sClient.Create(context.TODO(), sysconfig)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(k8sClient.Delete(context.TODO(), sysconfig)).To(Succeed())
+		})
+	}
+
+	computeNames := func() []string {
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(computes), computes)).To(Succeed())
+
+		names := []string{}
+		for _, data := range computes.Data {
+			names = append(names, data.Name)
+		}
+
+		return names
+	}
+
+	It("Assigns computes for directives that name them or when populating every workflow", func() {
+		Expect(r.assignsComputes(map[string]string{"action": "complete"})).To(BeFalse())
+		Expect(r.assignsComputes(map[string]string{"action": "complete", "computes": "node[0-1]"})).To(BeTrue())
+
+		r.PopulateComputes = true
+		Expect(r.assignsComputes(map[string]string{"action": "complete"})).To(BeTrue())
+	})
+
+	It("Waits for DWS to create the Computes resource", func() {
+		workflow.Status.Computes = corev1.ObjectReference{}
+		Expect(r.populateComputes(context.TODO(), workflow, map[string]string{})).To(BeFalse())
+
+		workflow.Status.Computes = corev1.ObjectReference{Name: computes.Name, Namespace: computes.Namespace}
+		Expect(r.populateComputes(context.TODO(), workflow, map[string]string{})).To(BeFalse())
+	})
+
+	It("Fills the Computes resource from the computes argument", func() {
+		createComputes()
+
+		Expect(r.populateComputes(context.TODO(), workflow, map[string]string{"computes": "node[01-03]"})).To(BeTrue())
+		Eventually(computeNames).Should(Equal([]string{"node01", "node02", "node03"}))
+	})
+
+	It("Fills the Computes resource from the SystemConfiguration", func() {
+		createComputes()
+		createSystemConfiguration("2x2+1")
+
+		r.PopulateComputes = true
+		Expect(r.populateComputes(context.TODO(), workflow, map[string]string{})).To(BeTrue())
+		Eventually(computeNames).Should(Equal([]string{"compute-000", "compute-001", "compute-002", "compute-003", "external-000"}))
+
+		// Computes that already have data are left alone
+		Expect(r.populateComputes(context.TODO(), workflow, map[string]string{"computes": "node[01-03]"})).To(BeTrue())
+		Consistently(computeNames).Should(HaveLen(5))
+	})
+
+	It("Prefers the driver's compute nodes to the SystemConfiguration", func() {
+		createComputes()
+		createSystemConfiguration("2x2")
+
+		r.ComputeNodes = []string{"node-a", "node-b"}
+		Expect(r.populateComputes(context.TODO(), workflow, map[string]string{})).To(BeTrue())
+		Eventually(computeNames).Should(Equal([]string{"node-a", "node-b"}))
+	})
+
+	It("Fails when there are no compute nodes to assign", func() {
+		createComputes()
+		createSystemConfiguration("1x0")
+
+		_, err := r.populateComputes(context.TODO(), workflow, map[string]string{})
+		resErr, ok := err.(*dwsv1alpha2.ResourceErrorInfo)
+		Expect(ok).To(BeTrue())
+		Expect(resErr.Type).To(Equal(dwsv1alpha2.TypeWLM))
+		Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+		Expect(resErr.GetUserMessage()).To(ContainSubstring("no compute nodes to assign to the job"))
+	})
+
+	It("Fails when there is no SystemConfiguration to take compute nodes from", func() {
+		createComputes()
+
+		_, err := r.populateComputes(context.TODO(), workflow, map[string]string{})
+		resErr, ok := err.(*dwsv1alpha2.ResourceErrorInfo)
+		Expect(ok).To(BeTrue())
+		Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityMajor))
+	})
+
+	It("Fails on an invalid computes argument", func() {
+		createComputes()
+
+		_, err := r.populateComputes(context.TODO(), workflow, map[string]string{"computes": "node[03-01]"})
+		resErr, ok := err.(*dwsv1alpha2.ResourceErrorInfo)
+		Expect(ok).To(BeTrue())
+		Expect(resErr.Type).To(Equal(dwsv1alpha2.TypeUser))
+	})
+})
@@ -0,0 +1,329 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// constraintError builds the error for an allocation placed by the WLM that
+// breaks a constraint of the DirectiveBreakdown
+func constraintError(format string, a ...any) *dwsv1alpha2.ResourceErrorInfo {
+	resErr := dwsv1alpha2.NewResourceError(format, a...).WithWLM().WithFatal()
+	resErr.UserMessage = "storage allocations violate the directive breakdown: " + resErr.DebugMessage
+
+	return resErr
+}
+
+// validateAllocations checks the allocation sets that the WLM placed in a
+// Servers resource against the constraints of the DirectiveBreakdown they
+// were placed for. Returns an error naming the first constraint that was
+// broken, or nil if the allocations meet every constraint.
+func validateAllocations(breakdownStatus *dwsv1alpha2.DirectiveBreakdownStatus, spec *dwsv1alpha2.ServersSpec) *dwsv1alpha2.ResourceErrorInfo {
+	if breakdownStatus.Storage == nil {
+		return nil
+	}
+
+	placed := map[string]dwsv1alpha2.ServersSpecAllocationSet{}
+	for _, allocationSet := range spec.AllocationSets {
+		if _, found := placed[allocationSet.Label]; found {
+			return constraintError("allocation set '%s' is placed more than once", allocationSet.Label)
+		}
+
+		placed[allocationSet.Label] = allocationSet
+	}
+
+	// The storage used by the allocation sets sharing each exclusive
+	// colocation key
+	exclusive := map[string]map[string]string{}
+
+	for _, constraints := range breakdownStatus.Storage.AllocationSets {
+		allocationSet, found := placed[constraints.Label]
+		if !found {
+			return constraintError("allocation set '%s' is not placed", constraints.Label)
+		}
+		delete(placed, constraints.Label)
+
+		if resErr := validateAllocationSet(constraints, allocationSet); resErr != nil {
+			return resErr
+		}
+
+		for _, colocation := range constraints.Constraints.Colocation {
+			if colocation.Type != colocationExclusive {
+				continue
+			}
+
+			if _, found := exclusive[colocation.Key]; !found {
+				exclusive[colocation.Key] = map[string]string{}
+			}
+
+			for _, storage := range allocationSet.Storage {
+				if storage.AllocationCount > 1 {
+					return constraintError("allocation set '%s' has %d allocations on storage '%s', breaking exclusive colocation key '%s'",
+						allocationSet.Label, storage.AllocationCount, storage.Name, colocation.Key)
+				}
+
+				if other, found := exclusive[colocation.Key][storage.Name]; found {
+					return constraintError("allocation sets '%s' and '%s' share storage '%s', breaking exclusive colocation key '%s'",
+						other, allocationSet.Label, storage.Name, colocation.Key)
+				}
+
+				exclusive[colocation.Key][storage.Name] = allocationSet.Label
+			}
+		}
+	}
+
+	for _, allocationSet := range spec.AllocationSets {
+		if _, found := placed[allocationSet.Label]; found {
+			return constraintError("allocation set '%s' is not in the directive breakdown", allocationSet.Label)
+		}
+	}
+
+	return nil
+}
+
+// validateAllocationSet checks a single allocation set against its allocation
+// strategy, count, and minimum capacity
+func validateAllocationSet(constraints dwsv1alpha2.StorageAllocationSet, allocationSet dwsv1alpha2.ServersSpecAllocationSet) *dwsv1alpha2.ResourceErrorInfo {
+	if len(allocationSet.Storage) == 0 {
+		return constraintError("allocation set '%s' has no storage", allocationSet.Label)
+	}
+
+	count := 0
+	seen := map[string]bool{}
+	for _, storage := range allocationSet.Storage {
+		if seen[storage.Name] {
+			return constraintError("allocation set '%s' lists storage '%s' more than once", allocationSet.Label, storage.Name)
+		}
+		seen[storage.Name] = true
+
+		if storage.AllocationCount < 1 {
+			return constraintError("allocation set '%s' has an allocation count of %d on storage '%s'",
+				allocationSet.Label, storage.AllocationCount, storage.Name)
+		}
+
+		count += storage.AllocationCount
+	}
+
+	if constraints.Constraints.Count > 0 && count != constraints.Constraints.Count {
+		return constraintError("allocation set '%s' has %d allocations, breaking count constraint %d",
+			allocationSet.Label, count, constraints.Constraints.Count)
+	}
+
+	switch constraints.AllocationStrategy {
+	case dwsv1alpha2.AllocateSingleServer:
+		if count != 1 {
+			return constraintError("allocation set '%s' has %d allocations, breaking strategy %s",
+				allocationSet.Label, count, constraints.AllocationStrategy)
+		}
+		fallthrough
+	case dwsv1alpha2.AllocatePerCompute:
+		if allocationSet.AllocationSize < constraints.MinimumCapacity {
+			return constraintError("allocation set '%s' has allocation size %d, below minimum capacity %d",
+				allocationSet.Label, allocationSet.AllocationSize, constraints.MinimumCapacity)
+		}
+	case dwsv1alpha2.AllocateAcrossServers:
+		if total := allocationSet.AllocationSize * int64(count); total < constraints.MinimumCapacity {
+			return constraintError("allocation set '%s' has total size %d, below minimum capacity %d",
+				allocationSet.Label, total, constraints.MinimumCapacity)
+		}
+	}
+
+	return nil
+}
+
+// validateStorageLabels checks that each storage holding an allocation set has
+// the labels that the DirectiveBreakdown requires of the set's storage. A
+// required label is either "key=value", or "key" when any value will do. The
+// labels of each storage are given by its name, and a storage that wasn't
+// found has none.
+func validateStorageLabels(breakdownStatus *dwsv1alpha2.DirectiveBreakdownStatus, spec *dwsv1alpha2.ServersSpec, labels map[string]map[string]string) *dwsv1alpha2.ResourceErrorInfo {
+	if breakdownStatus.Storage == nil {
+		return nil
+	}
+
+	required := map[string][]string{}
+	for _, constraints := range breakdownStatus.Storage.AllocationSets {
+		required[constraints.Label] = constraints.Constraints.Labels
+	}
+
+	for _, allocationSet := range spec.AllocationSets {
+		for _, storage := range allocationSet.Storage {
+			for _, label := range required[allocationSet.Label] {
+				key, value, hasValue := strings.Cut(label, "=")
+				if actual, found := labels[storage.Name][key]; !found || (hasValue && actual != value) {
+					return constraintError("allocation set '%s' is placed on storage '%s', which is missing label '%s'",
+						allocationSet.Label, storage.Name, label)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// exclusiveUse is a storage that an allocation set uses under an exclusive
+// colocation key
+type exclusiveUse struct {
+	key     string
+	storage string
+	label   string
+}
+
+// exclusiveUses returns the storage used under each exclusive colocation key
+// of a DirectiveBreakdown, given the storage of each allocation set by label
+func exclusiveUses(breakdownStatus *dwsv1alpha2.DirectiveBreakdownStatus, storage map[string][]string) []exclusiveUse {
+	uses := []exclusiveUse{}
+	if breakdownStatus.Storage == nil {
+		return uses
+	}
+
+	for _, constraints := range breakdownStatus.Storage.AllocationSets {
+		for _, colocation := range constraints.Constraints.Colocation {
+			if colocation.Type != colocationExclusive {
+				continue
+			}
+
+			for _, name := range storage[constraints.Label] {
+				uses = append(uses, exclusiveUse{key: colocation.Key, storage: name, label: constraints.Label})
+			}
+		}
+	}
+
+	return uses
+}
+
+// validateExclusiveColocation checks the allocation sets under exclusive
+// colocation keys against the storage that the allocations of other Servers
+// resources already hold under the same keys. The storage taken under each
+// key is mapped to a description of the allocation set holding it.
+func validateExclusiveColocation(breakdownStatus *dwsv1alpha2.DirectiveBreakdownStatus, spec *dwsv1alpha2.ServersSpec, taken map[string]map[string]string) *dwsv1alpha2.ResourceErrorInfo {
+	storage := map[string][]string{}
+	for _, allocationSet := range spec.AllocationSets {
+		for _, allocation := range allocationSet.Storage {
+			storage[allocationSet.Label] = append(storage[allocationSet.Label], allocation.Name)
+		}
+	}
+
+	for _, use := range exclusiveUses(breakdownStatus, storage) {
+		if other, found := taken[use.key][use.storage]; found {
+			return constraintError("allocation set '%s' shares storage '%s' with %s, breaking exclusive colocation key '%s'",
+				use.label, use.storage, other, use.key)
+		}
+	}
+
+	return nil
+}
+
+// storageLabels returns the labels of the Storage resources that hold the
+// allocation sets of a Servers resource. Storage that doesn't exist is left
+// out.
+func storageLabels(ctx context.Context, c client.Client, spec *dwsv1alpha2.ServersSpec) (map[string]map[string]string, error) {
+	labels := map[string]map[string]string{}
+	for _, allocationSet := range spec.AllocationSets {
+		for _, allocation := range allocationSet.Storage {
+			if _, found := labels[allocation.Name]; found {
+				continue
+			}
+
+			storage := &dwsv1alpha2.Storage{}
+			if err := c.Get(ctx, types.NamespacedName{Name: allocation.Name, Namespace: corev1.NamespaceDefault}, storage); err != nil {
+				if apierrors.IsNotFound(err) {
+					continue
+				}
+
+				return nil, err
+			}
+
+			labels[allocation.Name] = storage.GetLabels()
+		}
+	}
+
+	return labels, nil
+}
+
+// exclusiveStorageTaken finds the storage held under each exclusive colocation
+// key by the allocations of the driver's Servers resources, other than the
+// given one. Only allocations that were made are counted, so of two
+// placements that collide the one made first keeps its storage.
+func exclusiveStorageTaken(ctx context.Context, c client.Client, servers *dwsv1alpha2.Servers) (map[string]map[string]string, error) {
+	breakdowns := &dwsv1alpha2.DirectiveBreakdownList{}
+	if err := c.List(ctx, breakdowns, client.MatchingLabels{driverLabel: DRIVERID}); err != nil {
+		return nil, err
+	}
+
+	breakdownStatuses := map[string]*dwsv1alpha2.DirectiveBreakdownStatus{}
+	for i := range breakdowns.Items {
+		breakdown := &breakdowns.Items[i]
+		if breakdown.Status.Storage != nil {
+			breakdownStatuses[breakdown.Namespace+"/"+breakdown.Status.Storage.Reference.Name] = &breakdown.Status
+		}
+	}
+
+	serversList := &dwsv1alpha2.ServersList{}
+	if err := c.List(ctx, serversList, client.MatchingLabels{driverLabel: DRIVERID}); err != nil {
+		return nil, err
+	}
+
+	// Look at the Servers in a fixed order so that the error for a collision
+	// doesn't change from one attempt to the next
+	sort.Slice(serversList.Items, func(i, j int) bool {
+		return client.ObjectKeyFromObject(&serversList.Items[i]).String() < client.ObjectKeyFromObject(&serversList.Items[j]).String()
+	})
+
+	taken := map[string]map[string]string{}
+	for i := range serversList.Items {
+		other := &serversList.Items[i]
+		if other.GetUID() == servers.GetUID() || !other.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+
+		breakdownStatus, found := breakdownStatuses[other.Namespace+"/"+other.Name]
+		if !found {
+			continue
+		}
+
+		storage := map[string][]string{}
+		for _, allocationSet := range other.Status.AllocationSets {
+			for name := range allocationSet.Storage {
+				storage[allocationSet.Label] = append(storage[allocationSet.Label], name)
+			}
+			sort.Strings(storage[allocationSet.Label])
+		}
+
+		for _, use := range exclusiveUses(breakdownStatus, storage) {
+			if _, found := taken[use.key]; !found {
+				taken[use.key] = map[string]string{}
+			}
+
+			if _, found := taken[use.key][use.storage]; !found {
+				taken[use.key][use.storage] = fmt.Sprintf("allocation set '%s' of Servers '%s'", use.label, client.ObjectKeyFromObject(other))
+			}
+		}
+	}
+
+	return taken, nil
+}
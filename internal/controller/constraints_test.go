@@ -0,0 +1,148 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Allocation Constraints Test", func() {
+
+	const gb = 1000 * 1000 * 1000
+
+	var breakdownStatus *dwsv1alpha2.DirectiveBreakdownStatus
+	var spec *dwsv1alpha2.ServersSpec
+
+	allocationSet := func(label string, size int64, storage ...string) dwsv1alpha2.ServersSpecAllocationSet {
+		allocationSet := dwsv1alpha2.ServersSpecAllocationSet{Label: label, AllocationSize: size}
+		for _, name := range storage {
+			allocationSet.Storage = append(allocationSet.Storage, dwsv1alpha2.ServersSpecStorage{Name: name, AllocationCount: 1})
+		}
+
+		return allocationSet
+	}
+
+	BeforeEach(func() {
+		var resErr *dwsv1alpha2.ResourceErrorInfo
+		breakdownStatus, resErr = breakdownStorage(map[string]string{"type": "lustre", "capacity": "100GB"})
+		Expect(resErr).To(BeNil())
+
+		spec = &dwsv1alpha2.ServersSpec{
+			AllocationSets: []dwsv1alpha2.ServersSpecAllocationSet{
+				allocationSet("mgt", lustreMgtCapacity, "rabbit-0"),
+				allocationSet("mdt", lustreMdtCapacity/2, "rabbit-0", "rabbit-1"),
+				allocationSet("ost", 50*gb, "rabbit-0", "rabbit-1"),
+			},
+		}
+	})
+
+	It("Accepts allocations that meet the constraints", func() {
+		Expect(validateAllocations(breakdownStatus, spec)).To(BeNil())
+	})
+
+	DescribeTable("Rejects allocations that break a constraint",
+		func(modify func(), message string) {
+			modify()
+
+			resErr := validateAllocations(breakdownStatus, spec)
+			Expect(resErr).ToNot(BeNil())
+			Expect(resErr.Type).To(Equal(dwsv1alpha2.TypeWLM))
+			Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+			Expect(resErr.Error()).To(ContainSubstring(message))
+		},
+		Entry("with a missing allocation set",
+			func() { spec.AllocationSets = spec.AllocationSets[1:] },
+			"allocation set 'mgt' is not placed"),
+		Entry("with an unknown allocation set",
+			func() { spec.AllocationSets = append(spec.AllocationSets, allocationSet("xfs", gb, "rabbit-0")) },
+			"allocation set 'xfs' is not in the directive breakdown"),
+		Entry("with a duplicate allocation set",
+			func() { spec.AllocationSets = append(spec.AllocationSets, allocationSet("ost", gb, "rabbit-2")) },
+			"allocation set 'ost' is placed more than once"),
+		Entry("with a single server set on two servers",
+			func() { spec.AllocationSets[0] = allocationSet("mgt", lustreMgtCapacity, "rabbit-0", "rabbit-1") },
+			"breaking strategy AllocateSingleServer"),
+		Entry("with a set that is too small",
+			func() { spec.AllocationSets[2].AllocationSize = 10 * gb },
+			"below minimum capacity"),
+		Entry("with an exclusive set placed twice on the same storage",
+			func() { spec.AllocationSets[1].Storage[1].AllocationCount = 2 },
+			"breaking exclusive colocation key 'lustre-mdt'"),
+		Entry("with a set that has no storage",
+			func() { spec.AllocationSets[2].Storage = nil },
+			"allocation set 'ost' has no storage"),
+	)
+
+	It("Rejects sets that share storage under an exclusive colocation key", func() {
+		breakdownStatus.Storage.AllocationSets[2].Constraints.Colocation = breakdownStatus.Storage.AllocationSets[1].Constraints.Colocation
+
+		resErr := validateAllocations(breakdownStatus, spec)
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Error()).To(ContainSubstring("allocation sets 'mdt' and 'ost' share storage 'rabbit-0'"))
+	})
+
+	It("Rejects allocations that break the count constraint", func() {
+		breakdownStatus.Storage.AllocationSets[2].Constraints.Count = 4
+
+		resErr := validateAllocations(breakdownStatus, spec)
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Error()).To(ContainSubstring("breaking count constraint 4"))
+	})
+	It("Rejects storage that is missing a required label", func() {
+		labels := map[string]map[string]string{
+			"rabbit-0": {dwsv1alpha2.StorageTypeLabel: DRIVERID},
+			"rabbit-1": {dwsv1alpha2.StorageTypeLabel: DRIVERID},
+		}
+		Expect(validateStorageLabels(breakdownStatus, spec, labels)).To(BeNil())
+
+		labels["rabbit-1"][dwsv1alpha2.StorageTypeLabel] = "other"
+		resErr := validateStorageLabels(breakdownStatus, spec, labels)
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Error()).To(ContainSubstring("allocation set 'mdt' is placed on storage 'rabbit-1', which is missing label"))
+
+		delete(labels, "rabbit-1")
+		Expect(validateStorageLabels(breakdownStatus, spec, labels)).ToNot(BeNil())
+
+		breakdownStatus.Storage.AllocationSets[1].Constraints.Labels = []string{"rack"}
+		breakdownStatus.Storage.AllocationSets[2].Constraints.Labels = []string{"rack"}
+		labels["rabbit-0"]["rack"] = "a"
+		labels["rabbit-1"] = map[string]string{"rack": "b"}
+		Expect(validateStorageLabels(breakdownStatus, spec, labels)).To(BeNil())
+	})
+
+	It("Rejects storage held by another workflow under an exclusive colocation key", func() {
+		taken := map[string]map[string]string{"lustre-mdt": {"rabbit-2": "allocation set 'mdt' of Servers 'default/other'"}}
+		Expect(validateExclusiveColocation(breakdownStatus, spec, taken)).To(BeNil())
+
+		taken["lustre-mgt"] = map[string]string{"rabbit-0": "allocation set 'mgt' of Servers 'default/other'"}
+		resErr := validateExclusiveColocation(breakdownStatus, spec, taken)
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Error()).To(ContainSubstring("allocation set 'mgt' shares storage 'rabbit-0' with allocation set 'mgt' of Servers 'default/other'"))
+	})
+
+	It("Finds the storage used under each exclusive colocation key", func() {
+		uses := exclusiveUses(breakdownStatus, map[string][]string{"mgt": {"rabbit-0"}, "mdt": {"rabbit-0", "rabbit-1"}, "ost": {"rabbit-1"}})
+		Expect(uses).To(Equal([]exclusiveUse{
+			{key: "lustre-mgt", storage: "rabbit-0", label: "mgt"},
+			{key: "lustre-mdt", storage: "rabbit-0", label: "mdt"},
+			{key: "lustre-mdt", storage: "rabbit-1", label: "mdt"},
+		}))
+	})
+})
@@ -0,0 +1,354 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// copyProgressInterval is how often the driver status of a running copy is
+// refreshed with the number of files and bytes copied so far.
+const copyProgressInterval = 2 * time.Second
+
+// copyBufferSize is the size of the chunks read from a source file. The copy
+// checks for cancellation between chunks.
+const copyBufferSize = 1024 * 1024
+
+// checksumError is returned when the contents of a copied file do not match
+// the contents of its source.
+type checksumError struct {
+	path string
+}
+
+func (e *checksumError) Error() string {
+	return fmt.Sprintf("checksum mismatch on '%s'", e.path)
+}
+
+// copyJob is a directory tree copy running in the background on behalf of
+// a single driver status entry.
+type copyJob struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	files atomic.Int64
+	bytes atomic.Int64
+
+	// reported is when the progress of the copy was last written to the
+	// driver status
+	reported time.Time
+
+	// err is only valid after done is closed
+	err error
+}
+
+// finished returns true if the copy has stopped, along with the error that
+// stopped it, if any.
+func (j *copyJob) finished() (bool, error) {
+	select {
+	case <-j.done:
+		return true, j.err
+	default:
+		return false, nil
+	}
+}
+
+// progress returns a description of how much of the tree has been copied.
+func (j *copyJob) progress() string {
+	return fmt.Sprintf("%d files, %d bytes", j.files.Load(), j.bytes.Load())
+}
+
+// reportDue returns true if the progress of the copy is due to be written to
+// the driver status again. Every write of the workflow status queues another
+// reconcile, so progress is only reported once per copyProgressInterval.
+func (j *copyJob) reportDue(now time.Time) bool {
+	if now.Sub(j.reported) < copyProgressInterval {
+		return false
+	}
+
+	j.reported = now
+	return true
+}
+
+// copyTracker keeps track of the copies started by the driver. Copies are
+// indexed by the workflow they belong to and the index of their directive.
+type copyTracker struct {
+	sync.Mutex
+	jobs map[types.UID]map[int]*copyJob
+}
+
+func newCopyTracker() *copyTracker {
+	return &copyTracker{jobs: make(map[types.UID]map[int]*copyJob)}
+}
+
+// get returns the copy for a directive, or nil if one hasn't been started.
+func (t *copyTracker) get(uid types.UID, index int) *copyJob {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.jobs[uid][index]
+}
+
+// start begins copying src to dst in the background and records the copy
+// against the workflow and directive index.
+func (t *copyTracker) start(uid types.UID, index int, src string, dst string) *copyJob {
+	t.Lock()
+	defer t.Unlock()
+
+	if _, found := t.jobs[uid]; !found {
+		t.jobs[uid] = make(map[int]*copyJob)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &copyJob{cancel: cancel, done: make(chan struct{})}
+	t.jobs[uid][index] = job
+
+	go func() {
+		defer close(job.done)
+		job.err = copyTree(ctx, src, dst, job)
+	}()
+
+	return job
+}
+
+// cancel stops any copies that are still running for a workflow. Copies
+// that have finished are kept so their result is not lost.
+func (t *copyTracker) cancel(uid types.UID) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, job := range t.jobs[uid] {
+		job.cancel()
+	}
+}
+
+// remove drops the record of a finished copy so that the directive can start
+// the copy over again.
+func (t *copyTracker) remove(uid types.UID, index int) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.jobs[uid], index)
+}
+
+// forget stops any running copies for a workflow and drops all record of
+// them.
+func (t *copyTracker) forget(uid types.UID) {
+	t.Lock()
+	defer t.Unlock()
+
+	for _, job := range t.jobs[uid] {
+		job.cancel()
+	}
+
+	delete(t.jobs, uid)
+}
+
+// withinRoots returns true if path is at or below one of the roots.
+func withinRoots(path string, roots []string) bool {
+	for _, root := range roots {
+		rel, err := filepath.Rel(filepath.Clean(root), path)
+		if err != nil {
+			continue
+		}
+
+		if rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// validateCopyPaths checks the src and dst arguments of a copy directive
+// against the roots the driver is allowed to copy between.
+func validateCopyPaths(src string, dst string, roots []string) *dwsv1alpha2.ResourceErrorInfo {
+	if len(roots) == 0 {
+		return dwsv1alpha2.NewResourceError("copy action is disabled; no copy roots are configured").
+			WithUserMessage("copy action is not enabled in the driver").WithUser().WithFatal()
+	}
+
+	for _, path := range []string{src, dst} {
+		if !filepath.IsAbs(path) {
+			return dwsv1alpha2.NewResourceError("path '%s' is not absolute", path).
+				WithUserMessage("invalid copy path '%s'", path).WithUser().WithFatal()
+		}
+
+		if !withinRoots(filepath.Clean(path), roots) {
+			return dwsv1alpha2.NewResourceError("path '%s' is not under a copy root: %s", path, strings.Join(roots, ",")).
+				WithUserMessage("invalid copy path '%s'", path).WithUser().WithFatal()
+		}
+	}
+
+	if withinRoots(filepath.Clean(dst), []string{src}) {
+		return dwsv1alpha2.NewResourceError("destination '%s' is inside source '%s'", dst, src).
+			WithUserMessage("invalid copy destination '%s'", dst).WithUser().WithFatal()
+	}
+
+	return nil
+}
+
+// copyTree copies the directory tree at src to dst, verifying the contents
+// of each file after it is written. Counts of the files and bytes copied are
+// kept in job as the copy progresses.
+func copyTree(ctx context.Context, src string, dst string, job *copyJob) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			// A copy that is started over may find the link it left behind
+			if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+		case d.Type().IsRegular():
+			if err := copyFile(ctx, path, target, info.Mode().Perm(), job); err != nil {
+				return err
+			}
+		default:
+			// Sockets, devices, and pipes are not copied
+			return nil
+		}
+
+		job.files.Add(1)
+
+		return nil
+	})
+}
+
+// copyFile copies a single file and then reads it back to verify that its
+// checksum matches that of the source.
+func copyFile(ctx context.Context, src string, dst string, mode fs.FileMode, job *copyJob) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	buf := make([]byte, copyBufferSize)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, readErr := in.Read(buf)
+		if n > 0 {
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			hash.Write(buf[:n])
+			job.bytes.Add(int64(n))
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return readErr
+		}
+	}
+
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	sum, err := fileChecksum(dst)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(sum, hash.Sum(nil)) {
+		return &checksumError{path: dst}
+	}
+
+	return nil
+}
+
+// fileChecksum returns the sha256 checksum of the file at path.
+func fileChecksum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+
+	return hash.Sum(nil), nil
+}
+
+// copyError converts the error that stopped a copy into a resource error.
+// Checksum mismatches will not go away by retrying and are fatal; other I/O
+// errors may be transient.
+func copyError(err error) *dwsv1alpha2.ResourceErrorInfo {
+	if _, ok := err.(*checksumError); ok {
+		return dwsv1alpha2.NewResourceError("").WithError(err).
+			WithUserMessage("data corruption detected during copy").WithFatal()
+	}
+
+	return dwsv1alpha2.NewResourceError("").WithError(err).
+		WithUserMessage("I/O error during copy").WithMajor()
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Data Movement Test", func() {
+
+	var (
+		root string
+		src  string
+		dst  string
+	)
+
+	BeforeEach(func() {
+		root = GinkgoT().TempDir()
+		src = filepath.Join(root, "src")
+		dst = filepath.Join(root, "dst")
+
+		Expect(os.MkdirAll(filepath.Join(src, "a", "b"), 0755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(src, "top.dat"), []byte("0123456789"), 0644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(src, "a", "b", "nested.dat"), []byte("abcde"), 0600)).To(Succeed())
+	})
+
+	It("Copies a directory tree and counts files and bytes", func() {
+		job := &copyJob{}
+		Expect(copyTree(context.TODO(), src, dst, job)).To(Succeed())
+
+		Expect(os.ReadFile(filepath.Join(dst, "top.dat"))).To(Equal([]byte("0123456789")))
+		Expect(os.ReadFile(filepath.Join(dst, "a", "b", "nested.dat"))).To(Equal([]byte("abcde")))
+
+		Expect(job.files.Load()).To(BeEquivalentTo(2))
+		Expect(job.bytes.Load()).To(BeEquivalentTo(15))
+	})
+
+	It("Copies over a tree left behind by an earlier copy", func() {
+		Expect(os.Symlink("top.dat", filepath.Join(src, "link"))).To(Succeed())
+		Expect(copyTree(context.TODO(), src, dst, &copyJob{})).To(Succeed())
+
+		Expect(copyTree(context.TODO(), src, dst, &copyJob{})).To(Succeed())
+		Expect(os.Readlink(filepath.Join(dst, "link"))).To(Equal("top.dat"))
+	})
+
+	It("Starts a copy over after an error that isn't fatal", func() {
+		r := &WorkflowReconciler{Log: logr.Discard(), CopyRoots: []string{root}, copies: newCopyTracker()}
+		workflow := &dwsv1alpha2.Workflow{}
+		workflow.SetUID("uid")
+
+		// The destination can't be created under a file
+		args := map[string]string{"src": src, "dst": filepath.Join(root, "top", "dst")}
+		Expect(os.WriteFile(filepath.Join(root, "top"), []byte{}, 0644)).To(Succeed())
+
+		driverStatus := &dwsv1alpha2.WorkflowDriverStatus{DWDIndex: 0, WatchState: dwsv1alpha2.StateDataIn}
+		Expect(r.copyAction(workflow, driverStatus, args)).To(Equal(copyProgressInterval))
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusRunning))
+		Eventually(func() bool {
+			done, _ := r.copies.get("uid", 0).finished()
+			return done
+		}).Should(BeTrue())
+
+		Expect(r.copyAction(workflow, driverStatus, args)).To(Equal(resourceErrorRetryInterval))
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusTransientCondition))
+		Expect(r.copies.get("uid", 0)).To(BeNil())
+	})
+
+	It("Leaves the driver status alone when a copy is abandoned", func() {
+		r := &WorkflowReconciler{Log: logr.Discard(), CopyRoots: []string{root}, copies: newCopyTracker()}
+		workflow := &dwsv1alpha2.Workflow{}
+		workflow.SetUID("uid")
+
+		args := map[string]string{"src": src, "dst": dst}
+		driverStatus := &dwsv1alpha2.WorkflowDriverStatus{DWDIndex: 0, WatchState: dwsv1alpha2.StateDataIn}
+		job := r.copies.start("uid", 0, src, dst)
+		job.cancel()
+		<-job.done
+		job.err = context.Canceled
+
+		driverStatus.Status = dwsv1alpha2.StatusRunning
+		driverStatus.Message = "Copying: 0 files, 0 bytes"
+		expected := driverStatus.DeepCopy()
+
+		Expect(r.copyAction(workflow, driverStatus, args)).To(BeZero())
+		Expect(driverStatus).To(Equal(expected))
+		Expect(r.copies.get("uid", 0)).To(BeNil())
+	})
+
+	It("Stops copying when cancelled", func() {
+		ctx, cancel := context.WithCancel(context.TODO())
+		cancel()
+
+		Expect(copyTree(ctx, src, dst, &copyJob{})).To(MatchError(context.Canceled))
+		Expect(filepath.Join(dst, "top.dat")).ToNot(BeAnExistingFile())
+	})
+
+	It("Reports I/O errors as major and checksum errors as fatal", func() {
+		Expect(copyError(os.ErrPermission).Severity).To(Equal(dwsv1alpha2.SeverityMajor))
+		Expect(copyError(&checksumError{path: dst}).Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+	})
+
+	DescribeTable("Validates copy paths against the copy roots",
+		func(srcPath string, dstPath string, roots []string, valid bool) {
+			resErr := validateCopyPaths(srcPath, dstPath, roots)
+			if valid {
+				Expect(resErr).To(BeNil())
+			} else {
+				Expect(resErr).ToNot(BeNil())
+				Expect(resErr.Type).To(Equal(dwsv1alpha2.TypeUser))
+				Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+			}
+		},
+		Entry("under a root", "/data/in", "/data/out", []string{"/data"}, true),
+		Entry("under different roots", "/data/in", "/scratch/out", []string{"/data", "/scratch"}, true),
+		Entry("with no roots configured", "/data/in", "/data/out", []string{}, false),
+		Entry("outside of the roots", "/etc", "/data/out", []string{"/data"}, false),
+		Entry("escaping a root", "/data/../etc", "/data/out", []string{"/data"}, false),
+		Entry("with a root prefix", "/database", "/data/out", []string{"/data"}, false),
+		Entry("with a relative path", "data/in", "/data/out", []string{"/data"}, false),
+		Entry("with the destination inside the source", "/data/in", "/data/in/out", []string{"/data"}, false),
+	)
+})
@@ -0,0 +1,512 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// driverLabel marks the resources created by the driver
+const driverLabel = testerDomain + "driver"
+
+// colocationExclusive is the colocation constraint type that keeps the
+// allocation sets sharing a key on separate storage
+const colocationExclusive = "exclusive"
+
+// Capacities of the Lustre metadata allocation sets
+const (
+	lustreMgtCapacity = 1024 * 1024 * 1024
+	lustreMdtCapacity = 32 * 1024 * 1024 * 1024
+)
+
+// childDeletionInterval is how often to check on the deletion of the resources
+// that the driver created for a workflow
+const childDeletionInterval = time.Second
+
+// allocationPollInterval is how often to check on the allocations of a
+// directive's storage while waiting for them. Changes to the Servers resources
+// queue the workflow as well, so this only catches what the watch misses.
+const allocationPollInterval = 5 * time.Second
+
+var capacityMatcher = regexp.MustCompile(`^(\d+(?:\.\d+)?)([KMGTP]i?B?)?$`)
+
+var capacityUnits = map[string]float64{
+	"":    1,
+	"K":   1e3,
+	"KB":  1e3,
+	"KiB": 1 << 10,
+	"M":   1e6,
+	"MB":  1e6,
+	"MiB": 1 << 20,
+	"G":   1e9,
+	"GB":  1e9,
+	"GiB": 1 << 30,
+	"T":   1e12,
+	"TB":  1e12,
+	"TiB": 1 << 40,
+	"P":   1e15,
+	"PB":  1e15,
+	"PiB": 1 << 50,
+}
+
+// ParseCapacity parses a capacity such as "100GB" or "1.5TiB" into bytes.
+func ParseCapacity(value string) (int64, error) {
+	matches := capacityMatcher.FindStringSubmatch(value)
+	if matches == nil {
+		return 0, fmt.Errorf("invalid capacity '%s'", value)
+	}
+
+	multiplier, found := capacityUnits[matches[2]]
+	if !found {
+		return 0, fmt.Errorf("invalid capacity units '%s'", matches[2])
+	}
+
+	number, err := strconv.ParseFloat(matches[1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid capacity '%s'", value)
+	}
+
+	capacity := int64(number * multiplier)
+	if capacity <= 0 {
+		return 0, fmt.Errorf("invalid capacity '%s'", value)
+	}
+
+	return capacity, nil
+}
+
+// breakdownName returns the name shared by the DirectiveBreakdown and Servers
+// resources of a directive
+func breakdownName(workflow *dwsv1alpha2.Workflow, index int) string {
+	return fmt.Sprintf("%s-%d", workflow.Name, index)
+}
+
+// addDriverLabel marks a resource as belonging to the driver
+func addDriverLabel(object metav1.Object) {
+	labels := object.GetLabels()
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labels[driverLabel] = DRIVERID
+	object.SetLabels(labels)
+}
+
+// isDriverResource returns true if the resource belongs to the driver
+func isDriverResource(object client.Object) bool {
+	return object.GetLabels()[driverLabel] == DRIVERID
+}
+
+// workflowLabelMapFunc maps a resource to the workflow named by its workflow
+// labels
+func workflowLabelMapFunc(ctx context.Context, object client.Object) []reconcile.Request {
+	labels := object.GetLabels()
+
+	name, found := labels[dwsv1alpha2.WorkflowNameLabel]
+	if !found {
+		return []reconcile.Request{}
+	}
+
+	namespace, found := labels[dwsv1alpha2.WorkflowNamespaceLabel]
+	if !found {
+		return []reconcile.Request{}
+	}
+
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name, Namespace: namespace}}}
+}
+
+// isStorageCommand returns true for the directives that request storage
+func isStorageCommand(command string) bool {
+	switch command {
+	case "jobdw", "create_persistent", "persistentdw", "destroy_persistent":
+		return true
+	}
+
+	return false
+}
+
+// storageRequeueInterval returns how long to wait before looking at a storage
+// directive again when it hasn't reached a final result. Errors that aren't
+// fatal, such as a lack of capacity, are retried at the resource error pace.
+func storageRequeueInterval(driverStatus *dwsv1alpha2.WorkflowDriverStatus) time.Duration {
+	switch {
+	case driverStatus.Error != "":
+		return resourceErrorRetryInterval
+	case driverStatus.WatchState == dwsv1alpha2.StateTeardown:
+		return childDeletionInterval
+	}
+
+	return allocationPollInterval
+}
+
+// storageDirective handles the directives that request storage, the way a
+// storage driver would. Returns true once the driver status has reached a
+// final result for the state.
+func (r *WorkflowReconciler) storageDirective(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) (bool, error) {
+	switch args["command"] {
+	case "create_persistent":
+		return r.createPersistentDirective(ctx, workflow, driverStatus, args)
+	case "persistentdw":
+		return r.persistentdwDirective(ctx, workflow, driverStatus, args)
+	case "destroy_persistent":
+		return r.destroyPersistentDirective(ctx, workflow, driverStatus, args)
+	}
+
+	switch workflow.Spec.DesiredState {
+	case dwsv1alpha2.StateProposal:
+		return r.createBreakdown(ctx, workflow, driverStatus, args, nil)
+	case dwsv1alpha2.StateSetup:
+		return r.waitForAllocations(ctx, workflow, driverStatus, breakdownName(workflow, driverStatus.DWDIndex), workflow.Namespace)
+	case dwsv1alpha2.StateTeardown:
+		return r.deleteBreakdowns(ctx, workflow, driverStatus)
+	}
+
+	completeDriverStatus(driverStatus)
+	return true, nil
+}
+
+// createBreakdown creates the DirectiveBreakdown and Servers resources for a
+// directive and records the DirectiveBreakdown in the workflow status. The
+// Servers resource of persistent storage belongs to its
+// PersistentStorageInstance and shares its name, so that it outlives the
+// workflow.
+func (r *WorkflowReconciler) createBreakdown(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string, psi *dwsv1alpha2.PersistentStorageInstance) (bool, error) {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow), "index", driverStatus.DWDIndex)
+
+	breakdownStatus, resErr := breakdownStorage(args)
+	if resErr != nil {
+		setDriverError(driverStatus, resErr)
+		return true, nil
+	}
+
+	// Storage that can't fit in the free capacity is refused before anything
+	// is created for it
+	ledger, err := loadCapacityLedger(ctx, r.Client, "")
+	if err != nil {
+		return false, err
+	}
+
+	if free, limited := ledger.totalFree(); limited && requestedCapacity(breakdownStatus) > free {
+		resErr := insufficientCapacityError("", requestedCapacity(breakdownStatus), free, r.CapacitySeverity)
+		log.Info("Insufficient capacity", "error", resErr.Error())
+		setDriverError(driverStatus, resErr)
+		return resErr.Severity == dwsv1alpha2.SeverityFatal, nil
+	}
+
+	name := breakdownName(workflow, driverStatus.DWDIndex)
+	breakdown := &dwsv1alpha2.DirectiveBreakdown{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: workflow.Namespace,
+		},
+	}
+
+	result, err := ctrl.CreateOrUpdate(ctx, r.Client, breakdown,
+		func() error {
+			dwsv1alpha2.AddWorkflowLabels(breakdown, workflow)
+			dwsv1alpha2.AddOwnerLabels(breakdown, workflow)
+			addDriverLabel(breakdown)
+
+			breakdown.Spec.Directive = workflow.Spec.DWDirectives[driverStatus.DWDIndex]
+			breakdown.Spec.UserID = workflow.Spec.UserID
+
+			return ctrl.SetControllerReference(workflow, breakdown, r.Scheme)
+		})
+	if err != nil {
+		log.Error(err, "Failed to create or update DirectiveBreakdown", "name", name)
+		return false, err
+	}
+	if result == controllerutil.OperationResultCreated {
+		log.Info("Created DirectiveBreakdown", "name", name)
+	}
+
+	servers := &dwsv1alpha2.Servers{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: workflow.Namespace,
+		},
+	}
+	if psi != nil {
+		servers.Name = psi.Name
+		breakdownStatus.Storage.Lifetime = dwsv1alpha2.StorageLifetimePersistent
+	}
+
+	result, err = ctrl.CreateOrUpdate(ctx, r.Client, servers,
+		func() error {
+			addDriverLabel(servers)
+
+			if psi != nil {
+				dwsv1alpha2.AddPersistentStorageLabels(servers, psi)
+				dwsv1alpha2.AddOwnerLabels(servers, psi)
+
+				return ctrl.SetControllerReference(psi, servers, r.Scheme)
+			}
+
+			dwsv1alpha2.AddWorkflowLabels(servers, workflow)
+			dwsv1alpha2.AddOwnerLabels(servers, breakdown)
+
+			return ctrl.SetControllerReference(breakdown, servers, r.Scheme)
+		})
+	if err != nil {
+		log.Error(err, "Failed to create or update Servers", "name", servers.Name)
+		return false, err
+	}
+	if result == controllerutil.OperationResultCreated {
+		log.Info("Created Servers", "name", servers.Name)
+	}
+
+	// Both the storage and the compute constraints refer to the Servers
+	// resource where the WLM will place the allocations.
+	serversReference := corev1.ObjectReference{
+		Kind:      reflect.TypeOf(dwsv1alpha2.Servers{}).Name(),
+		Name:      servers.Name,
+		Namespace: servers.Namespace,
+	}
+	breakdownStatus.Storage.Reference = serversReference
+	breakdownStatus.Compute.Constraints.Location[0].Reference = serversReference
+	breakdownStatus.Ready = true
+
+	if !reflect.DeepEqual(breakdown.Status, *breakdownStatus) {
+		breakdown.Status = *breakdownStatus
+		if err := r.Status().Update(ctx, breakdown); err != nil {
+			return false, client.IgnoreNotFound(err)
+		}
+	}
+
+	breakdownReference := corev1.ObjectReference{
+		Kind:      reflect.TypeOf(dwsv1alpha2.DirectiveBreakdown{}).Name(),
+		Name:      breakdown.Name,
+		Namespace: breakdown.Namespace,
+	}
+
+	found := false
+	for _, reference := range workflow.Status.DirectiveBreakdowns {
+		if reference == breakdownReference {
+			found = true
+		}
+	}
+	if !found {
+		workflow.Status.DirectiveBreakdowns = append(workflow.Status.DirectiveBreakdowns, breakdownReference)
+	}
+
+	completeDriverStatus(driverStatus)
+	return true, nil
+}
+
+// waitForAllocations waits for the storage to report the allocations that the
+// WLM placed in the Servers resource of a directive, and checks that the
+// workflow's compute nodes can reach them. An error reported by the storage is
+// passed on to the driver status. Returns true once the driver status has
+// reached a final result.
+func (r *WorkflowReconciler) waitForAllocations(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, name string, namespace string) (bool, error) {
+	servers := &dwsv1alpha2.Servers{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, servers); err != nil {
+		if apierrors.IsNotFound(err) {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("could not find Servers for directive %d", driverStatus.DWDIndex).
+				WithError(err).WithFatal())
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	if servers.Status.Error != nil {
+		setDriverError(driverStatus, servers.Status.Error)
+		return servers.Status.Error.Severity == dwsv1alpha2.SeverityFatal, nil
+	}
+
+	if !servers.Status.Ready {
+		driverStatus.Status = dwsv1alpha2.StatusRunning
+		driverStatus.Message = "Waiting for storage allocations"
+		driverStatus.Error = ""
+		return false, nil
+	}
+
+	resErr, err := r.computeAccess(ctx, workflow, servers)
+	if err != nil {
+		return false, err
+	}
+	if resErr != nil {
+		setDriverError(driverStatus, resErr)
+		return resErr.Severity == dwsv1alpha2.SeverityFatal, nil
+	}
+
+	completeDriverStatus(driverStatus)
+	return true, nil
+}
+
+// requestedCapacity returns the least capacity that the allocation sets of a
+// DirectiveBreakdown need. Allocations made for each compute are counted once,
+// since the number of computes isn't known until the WLM places them.
+func requestedCapacity(breakdownStatus *dwsv1alpha2.DirectiveBreakdownStatus) int64 {
+	requested := int64(0)
+	for _, allocationSet := range breakdownStatus.Storage.AllocationSets {
+		requested += allocationSet.MinimumCapacity
+	}
+
+	return requested
+}
+
+// breakdownStorage builds the status of the DirectiveBreakdown for a directive
+// from its type and capacity arguments. File systems that are local to a
+// compute node get one allocation per compute and require that the computes be
+// physically attached to the storage. Lustre gets its metadata and object
+// storage targets spread across the storage and may be reached over the
+// network.
+func breakdownStorage(args map[string]string) (*dwsv1alpha2.DirectiveBreakdownStatus, *dwsv1alpha2.ResourceErrorInfo) {
+	capacity, err := ParseCapacity(args["capacity"])
+	if err != nil {
+		return nil, dwsv1alpha2.NewResourceError("").WithError(err).
+			WithUserMessage("invalid 'capacity' argument '%s'", args["capacity"]).WithUser().WithFatal()
+	}
+
+	storageLabels := []string{dwsv1alpha2.StorageTypeLabel + "=" + DRIVERID}
+	status := &dwsv1alpha2.DirectiveBreakdownStatus{
+		Storage: &dwsv1alpha2.StorageBreakdown{
+			Lifetime: dwsv1alpha2.StorageLifetimeJob,
+		},
+		Compute: &dwsv1alpha2.ComputeBreakdown{},
+	}
+
+	var locationType dwsv1alpha2.ComputeLocationType
+
+	switch args["type"] {
+	case "raw", "xfs", "gfs2":
+		locationType = dwsv1alpha2.ComputeLocationPhysical
+		status.Storage.AllocationSets = []dwsv1alpha2.StorageAllocationSet{
+			{
+				Label:              args["type"],
+				AllocationStrategy: dwsv1alpha2.AllocatePerCompute,
+				MinimumCapacity:    capacity,
+				Constraints: dwsv1alpha2.AllocationSetConstraints{
+					Labels: storageLabels,
+				},
+			},
+		}
+	case "lustre":
+		locationType = dwsv1alpha2.ComputeLocationNetwork
+		status.Storage.AllocationSets = []dwsv1alpha2.StorageAllocationSet{
+			{
+				Label:              "mgt",
+				AllocationStrategy: dwsv1alpha2.AllocateSingleServer,
+				MinimumCapacity:    lustreMgtCapacity,
+				Constraints: dwsv1alpha2.AllocationSetConstraints{
+					Labels:     storageLabels,
+					Colocation: []dwsv1alpha2.AllocationSetColocationConstraint{{Type: colocationExclusive, Key: "lustre-mgt"}},
+				},
+			},
+			{
+				Label:              "mdt",
+				AllocationStrategy: dwsv1alpha2.AllocateAcrossServers,
+				MinimumCapacity:    lustreMdtCapacity,
+				Constraints: dwsv1alpha2.AllocationSetConstraints{
+					Labels:     storageLabels,
+					Colocation: []dwsv1alpha2.AllocationSetColocationConstraint{{Type: colocationExclusive, Key: "lustre-mdt"}},
+				},
+			},
+			{
+				Label:              "ost",
+				AllocationStrategy: dwsv1alpha2.AllocateAcrossServers,
+				MinimumCapacity:    capacity,
+				Constraints: dwsv1alpha2.AllocationSetConstraints{
+					Labels: storageLabels,
+				},
+			},
+		}
+	default:
+		return nil, dwsv1alpha2.NewResourceError("unsupported file system type '%s'", args["type"]).
+			WithUserMessage("invalid 'type' argument '%s'", args["type"]).WithUser().WithFatal()
+	}
+
+	status.Compute.Constraints.Location = []dwsv1alpha2.ComputeLocationConstraint{
+		{
+			Access: []dwsv1alpha2.ComputeLocationAccess{
+				{
+					Type:     locationType,
+					Priority: dwsv1alpha2.ComputeLocationPriorityMandatory,
+				},
+			},
+		},
+	}
+
+	return status, nil
+}
+
+// deleteBreakdowns deletes the Servers and DirectiveBreakdown resources that
+// the driver created for the workflow. The Servers go first so that they're
+// never left without the breakdown that describes them. Returns true once all
+// of them are gone.
+func (r *WorkflowReconciler) deleteBreakdowns(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus) (bool, error) {
+	for _, object := range []client.Object{&dwsv1alpha2.Servers{}, &dwsv1alpha2.DirectiveBreakdown{}} {
+		deleted, err := r.deleteDriverChildren(ctx, workflow, object)
+		if err != nil {
+			return false, err
+		}
+
+		if !deleted {
+			driverStatus.Status = dwsv1alpha2.StatusRunning
+			return false, nil
+		}
+	}
+
+	completeDriverStatus(driverStatus)
+	return true, nil
+}
+
+// deleteDriverChildren deletes the resources of the given type that the driver
+// created for the workflow. Returns true once none are left.
+func (r *WorkflowReconciler) deleteDriverChildren(ctx context.Context, workflow *dwsv1alpha2.Workflow, object client.Object) (bool, error) {
+	var list client.ObjectList
+	switch object.(type) {
+	case *dwsv1alpha2.Servers:
+		list = &dwsv1alpha2.ServersList{}
+	case *dwsv1alpha2.DirectiveBreakdown:
+		list = &dwsv1alpha2.DirectiveBreakdownList{}
+	default:
+		return false, fmt.Errorf("unsupported child type %T", object)
+	}
+
+	matchingLabels := dwsv1alpha2.MatchingWorkflow(workflow)
+	matchingLabels[driverLabel] = DRIVERID
+
+	if err := r.List(ctx, list, client.InNamespace(workflow.Namespace), matchingLabels); err != nil {
+		return false, err
+	}
+
+	if len(list.(dwsv1alpha2.ObjectList).GetObjectList()) == 0 {
+		return true, nil
+	}
+
+	if err := r.DeleteAllOf(ctx, object, client.InNamespace(workflow.Namespace), matchingLabels); err != nil {
+		return false, err
+	}
+
+	return false, nil
+}
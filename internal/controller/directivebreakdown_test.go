@@ -0,0 +1,95 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("DirectiveBreakdown Test", func() {
+
+	DescribeTable("Parses capacities",
+		func(value string, expected int64) {
+			Expect(ParseCapacity(value)).To(Equal(expected))
+		},
+		Entry("without units", "4096", int64(4096)),
+		Entry("with decimal units", "10GB", int64(10*1000*1000*1000)),
+		Entry("with short decimal units", "2T", int64(2*1000*1000*1000*1000)),
+		Entry("with binary units", "1GiB", int64(1024*1024*1024)),
+		Entry("with a fraction", "1.5KiB", int64(1536)),
+	)
+
+	DescribeTable("Rejects invalid capacities",
+		func(value string) {
+			_, err := ParseCapacity(value)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("that are empty", ""),
+		Entry("that are zero", "0GB"),
+		Entry("with unknown units", "1XB"),
+		Entry("that are negative", "-1GB"),
+	)
+
+	It("Allocates local file systems per compute", func() {
+		status, resErr := breakdownStorage(map[string]string{"type": "xfs", "capacity": "1GiB"})
+		Expect(resErr).To(BeNil())
+
+		Expect(status.Storage.Lifetime).To(Equal(dwsv1alpha2.StorageLifetimeJob))
+		Expect(status.Storage.AllocationSets).To(HaveLen(1))
+		Expect(status.Storage.AllocationSets[0].AllocationStrategy).To(Equal(dwsv1alpha2.AllocatePerCompute))
+		Expect(status.Storage.AllocationSets[0].MinimumCapacity).To(Equal(int64(1024 * 1024 * 1024)))
+		Expect(status.Compute.Constraints.Location[0].Access[0].Type).To(Equal(dwsv1alpha2.ComputeLocationPhysical))
+	})
+
+	It("Spreads Lustre targets across the storage", func() {
+		status, resErr := breakdownStorage(map[string]string{"type": "lustre", "capacity": "1TB"})
+		Expect(resErr).To(BeNil())
+
+		strategies := map[string]dwsv1alpha2.AllocationStrategy{}
+		for _, allocationSet := range status.Storage.AllocationSets {
+			strategies[allocationSet.Label] = allocationSet.AllocationStrategy
+		}
+		Expect(strategies).To(Equal(map[string]dwsv1alpha2.AllocationStrategy{
+			"mgt": dwsv1alpha2.AllocateSingleServer,
+			"mdt": dwsv1alpha2.AllocateAcrossServers,
+			"ost": dwsv1alpha2.AllocateAcrossServers,
+		}))
+		Expect(status.Compute.Constraints.Location[0].Access[0].Type).To(Equal(dwsv1alpha2.ComputeLocationNetwork))
+	})
+
+	It("Fails on invalid capacities", func() {
+		_, resErr := breakdownStorage(map[string]string{"type": "xfs", "capacity": "lots"})
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+	})
+
+	DescribeTable("Requeues storage directives that are in progress",
+		func(state dwsv1alpha2.WorkflowState, errorMessage string, expected time.Duration) {
+			driverStatus := &dwsv1alpha2.WorkflowDriverStatus{WatchState: state, Error: errorMessage}
+			Expect(storageRequeueInterval(driverStatus)).To(Equal(expected))
+		},
+		Entry("waiting for allocations", dwsv1alpha2.StateSetup, "", allocationPollInterval),
+		Entry("with insufficient capacity", dwsv1alpha2.StateProposal, "insufficient capacity", resourceErrorRetryInterval),
+		Entry("with an allocation error", dwsv1alpha2.StateSetup, "allocation failed", resourceErrorRetryInterval),
+		Entry("deleting resources", dwsv1alpha2.StateTeardown, "", childDeletionInterval),
+	)
+})
@@ -0,0 +1,119 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExpandHostlist expands a comma separated list of host names, where each name
+// may contain bracketed ranges, into the individual host names. For example,
+// "node[01-03,7],login" expands to node01, node02, node03, node7, and login.
+// Leading zeros in the start of a range set the width of the numbers.
+func ExpandHostlist(hostlist string) ([]string, error) {
+	hosts := []string{}
+
+	for _, pattern := range splitHostlist(hostlist) {
+		if pattern == "" {
+			continue
+		}
+
+		expanded, err := expandHostPattern(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostlist '%s': %w", hostlist, err)
+		}
+
+		hosts = append(hosts, expanded...)
+	}
+
+	return hosts, nil
+}
+
+// splitHostlist splits a hostlist on the commas that are outside of brackets
+func splitHostlist(hostlist string) []string {
+	patterns := []string{}
+
+	depth, start := 0, 0
+	for i, c := range hostlist {
+		switch c {
+		case '[':
+			depth++
+		case ']':
+			depth--
+		case ',':
+			if depth == 0 {
+				patterns = append(patterns, strings.TrimSpace(hostlist[start:i]))
+				start = i + 1
+			}
+		}
+	}
+
+	return append(patterns, strings.TrimSpace(hostlist[start:]))
+}
+
+// expandHostPattern expands the first bracketed range in a host name and then
+// recursively expands the remainder of the name.
+func expandHostPattern(pattern string) ([]string, error) {
+	lbracket := strings.Index(pattern, "[")
+	if lbracket == -1 {
+		if strings.Contains(pattern, "]") {
+			return nil, fmt.Errorf("unbalanced brackets in '%s'", pattern)
+		}
+
+		return []string{pattern}, nil
+	}
+
+	rbracket := strings.Index(pattern[lbracket:], "]")
+	if rbracket == -1 {
+		return nil, fmt.Errorf("unbalanced brackets in '%s'", pattern)
+	}
+	rbracket += lbracket
+
+	prefix := pattern[:lbracket]
+	suffixes, err := expandHostPattern(pattern[rbracket+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := []string{}
+	for _, element := range strings.Split(pattern[lbracket+1:rbracket], ",") {
+		first, last, isRange := strings.Cut(element, "-")
+		if !isRange {
+			last = first
+		}
+
+		start, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range '%s'", element)
+		}
+
+		end, err := strconv.Atoi(last)
+		if err != nil || end < start {
+			return nil, fmt.Errorf("invalid range '%s'", element)
+		}
+
+		for i := start; i <= end; i++ {
+			for _, suffix := range suffixes {
+				hosts = append(hosts, fmt.Sprintf("%s%0*d%s", prefix, len(first), i, suffix))
+			}
+		}
+	}
+
+	return hosts, nil
+}
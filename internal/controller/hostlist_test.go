@@ -0,0 +1,49 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Hostlist Test", func() {
+
+	DescribeTable("Expands hostlists",
+		func(hostlist string, expected []string) {
+			Expect(ExpandHostlist(hostlist)).To(Equal(expected))
+		},
+		Entry("with an empty list", "", []string{}),
+		Entry("with plain names", "login,compute", []string{"login", "compute"}),
+		Entry("with a range", "node[1-3]", []string{"node1", "node2", "node3"}),
+		Entry("with a zero padded range", "node[08-10]", []string{"node08", "node09", "node10"}),
+		Entry("with ranges and single numbers", "node[1-2,7]", []string{"node1", "node2", "node7"}),
+		Entry("with several bracketed ranges", "r[1-2]n[1-2]", []string{"r1n1", "r1n2", "r2n1", "r2n2"}),
+		Entry("with a mix of names and ranges", "login,node[1-2]", []string{"login", "node1", "node2"}),
+	)
+
+	DescribeTable("Rejects invalid hostlists",
+		func(hostlist string) {
+			_, err := ExpandHostlist(hostlist)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("with an unclosed bracket", "node[1-3"),
+		Entry("with an unopened bracket", "node1-3]"),
+		Entry("with a decreasing range", "node[3-1]"),
+		Entry("with a non-numeric range", "node[a-c]"),
+	)
+})
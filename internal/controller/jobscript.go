@@ -0,0 +1,72 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// directivePrefix starts the #DW directives in a job script
+const directivePrefix = "#DW"
+
+// ParseJobScript returns the #DW directives in a batch job script, such as a
+// Slurm or Flux script. Like the #SBATCH lines of a Slurm script, directives
+// are read from the comments at the top of the script and reading stops at the
+// first command. Lines that start with one of the aliases, such as "#BB", are
+// read as #DW directives too.
+func ParseJobScript(script io.Reader, aliases []string) ([]string, error) {
+	prefixes := append([]string{directivePrefix}, aliases...)
+	directives := []string{}
+
+	scanner := bufio.NewScanner(script)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+
+		for _, prefix := range prefixes {
+			// The prefix must be a word of its own, so "#DWARF" isn't a
+			// directive
+			rest := strings.TrimPrefix(line, prefix)
+			fields := strings.Fields(rest)
+			if !strings.HasPrefix(line, prefix) || len(fields) == 0 || !strings.HasPrefix(rest, " ") && !strings.HasPrefix(rest, "\t") {
+				continue
+			}
+
+			directives = append(directives, directivePrefix+" "+strings.Join(fields, " "))
+			break
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(directives) == 0 {
+		return nil, fmt.Errorf("no %s directives found", strings.Join(prefixes, " or "))
+	}
+
+	return directives, nil
+}
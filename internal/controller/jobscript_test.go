@@ -0,0 +1,66 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Job Script Test", func() {
+
+	It("Reads the directives at the top of a Slurm script", func() {
+		script := `#!/bin/bash
+#SBATCH --nodes=2
+
+#DW jobdw type=xfs capacity=1GB name=scratch
+#DW   Setup	action=complete
+#DWARF is not a directive
+srun hostname
+#DW Teardown action=complete
+`
+
+		directives, err := ParseJobScript(strings.NewReader(script), nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(directives).To(Equal([]string{
+			"#DW jobdw type=xfs capacity=1GB name=scratch",
+			"#DW Setup action=complete",
+		}))
+	})
+
+	It("Reads aliases as directives", func() {
+		script := `#!/bin/sh
+#flux: -N 2
+#BB jobdw type=lustre capacity=1TB name=scratch
+#DW PreRun action=complete
+`
+
+		directives, err := ParseJobScript(strings.NewReader(script), []string{"#BB"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(directives).To(Equal([]string{
+			"#DW jobdw type=lustre capacity=1TB name=scratch",
+			"#DW PreRun action=complete",
+		}))
+	})
+
+	It("Rejects scripts without directives", func() {
+		_, err := ParseJobScript(strings.NewReader("#!/bin/bash\n#BB Setup action=complete\n"), nil)
+		Expect(err).To(MatchError("no #DW directives found"))
+	})
+})
@@ -0,0 +1,116 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Latency is a delay injected before the driver writes its status. The delay
+// is picked at random between Min and Max; a fixed delay has Min equal to Max.
+type Latency struct {
+	Min time.Duration
+	Max time.Duration
+}
+
+var (
+	latencyRandLock sync.Mutex
+	latencyRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// ParseLatency parses a latency of the form "500ms" for a fixed delay, or
+// "100ms-2s" for a delay picked at random from the range.
+func ParseLatency(value string) (Latency, error) {
+	minValue, maxValue, isRange := strings.Cut(value, "-")
+	if !isRange {
+		maxValue = minValue
+	}
+
+	min, err := time.ParseDuration(minValue)
+	if err != nil {
+		return Latency{}, fmt.Errorf("invalid latency '%s': %w", value, err)
+	}
+
+	max, err := time.ParseDuration(maxValue)
+	if err != nil {
+		return Latency{}, fmt.Errorf("invalid latency '%s': %w", value, err)
+	}
+
+	if min < 0 || max < min {
+		return Latency{}, fmt.Errorf("invalid latency '%s': range must not be negative or decreasing", value)
+	}
+
+	return Latency{Min: min, Max: max}, nil
+}
+
+// Pick returns a delay from the latency's range.
+func (l Latency) Pick() time.Duration {
+	if l.Max <= l.Min {
+		return l.Min
+	}
+
+	latencyRandLock.Lock()
+	defer latencyRandLock.Unlock()
+
+	return l.Min + time.Duration(latencyRand.Int63n(int64(l.Max-l.Min)+1))
+}
+
+// latencyTracker keeps track of when the delayed status update of each
+// workflow is due
+type latencyTracker struct {
+	sync.Mutex
+	due map[types.UID]time.Time
+}
+
+func newLatencyTracker() *latencyTracker {
+	return &latencyTracker{due: make(map[types.UID]time.Time)}
+}
+
+// hold returns how much longer the status update of a workflow is held back.
+// The delay is taken from the first call, and the hold is released once it
+// has passed.
+func (t *latencyTracker) hold(uid types.UID, delay time.Duration, now time.Time) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+
+	due, found := t.due[uid]
+	if !found {
+		t.due[uid] = now.Add(delay)
+		return delay
+	}
+
+	if remaining := due.Sub(now); remaining > 0 {
+		return remaining
+	}
+
+	delete(t.due, uid)
+	return 0
+}
+
+// forget drops the held status update of a workflow
+func (t *latencyTracker) forget(uid types.UID) {
+	t.Lock()
+	defer t.Unlock()
+
+	delete(t.due, uid)
+}
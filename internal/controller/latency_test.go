@@ -0,0 +1,90 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Latency Test", func() {
+
+	DescribeTable("Parses latencies",
+		func(value string, expected Latency) {
+			Expect(ParseLatency(value)).To(Equal(expected))
+		},
+		Entry("with no delay", "0s", Latency{}),
+		Entry("with a fixed delay", "500ms", Latency{Min: 500 * time.Millisecond, Max: 500 * time.Millisecond}),
+		Entry("with a range", "100ms-2s", Latency{Min: 100 * time.Millisecond, Max: 2 * time.Second}),
+	)
+
+	DescribeTable("Rejects invalid latencies",
+		func(value string) {
+			_, err := ParseLatency(value)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("without units", "500"),
+		Entry("with a decreasing range", "2s-100ms"),
+		Entry("with an incomplete range", "100ms-"),
+	)
+
+	It("Picks delays from the range", func() {
+		latency := Latency{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond}
+		for i := 0; i < 100; i++ {
+			Expect(latency.Pick()).To(SatisfyAll(
+				BeNumerically(">=", latency.Min),
+				BeNumerically("<=", latency.Max),
+			))
+		}
+	})
+	It("Holds status updates until their delay has passed", func() {
+		tracker := newLatencyTracker()
+		start := time.Now()
+
+		Expect(tracker.hold("uid", 2*time.Second, start)).To(Equal(2 * time.Second))
+
+		// Later delays don't move the update that is already held
+		Expect(tracker.hold("uid", 5*time.Second, start.Add(time.Second))).To(Equal(time.Second))
+		Expect(tracker.hold("uid", 5*time.Second, start.Add(2*time.Second))).To(BeZero())
+
+		// The next update is held from scratch
+		Expect(tracker.hold("uid", time.Second, start.Add(3*time.Second))).To(Equal(time.Second))
+		tracker.forget("uid")
+		Expect(tracker.hold("uid", 3*time.Second, start.Add(3*time.Second))).To(Equal(3 * time.Second))
+	})
+
+	It("Leaves the status as it was read while an update is held", func() {
+		r := &WorkflowReconciler{Log: logr.Discard(), StatusLatency: Latency{Min: time.Minute, Max: time.Minute}, latencies: newLatencyTracker()}
+		workflow := &dwsv1alpha2.Workflow{}
+		workflow.SetUID("uid")
+		workflow.Spec.DWDirectives = []string{"#DW Proposal action=complete"}
+		workflow.Status.Drivers = []dwsv1alpha2.WorkflowDriverStatus{{DriverID: DRIVERID, WatchState: dwsv1alpha2.StateProposal, Status: dwsv1alpha2.StatusPending}}
+		original := workflow.Status.DeepCopy()
+
+		completeDriverStatus(&workflow.Status.Drivers[0])
+		res := ctrl.Result{}
+		r.delayStatusUpdate(workflow, original, &res)
+		Expect(workflow.Status).To(Equal(*original))
+		Expect(res.RequeueAfter).To(Equal(time.Minute))
+	})
+})
@@ -0,0 +1,127 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	dwdparse "github.com/DataWorkflowServices/dws/utils/dwdparse"
+)
+
+// workflowFinalizer keeps a workflow with tester directives around until the
+// driver lets it go, as chosen by the ondelete arguments of its directives
+const workflowFinalizer = testerDomain + "workflow"
+
+// releaseAnnotation lets go of a workflow whose deletion is blocked by an
+// ondelete=block argument
+const releaseAnnotation = testerDomain + "release"
+
+// onDelete is what the driver does when a workflow is deleted
+type onDelete struct {
+	// block holds the workflow until it has the release annotation
+	block bool
+
+	// delay holds the workflow for a time after its deletion
+	delay time.Duration
+}
+
+// parseOnDelete parses an ondelete argument: "immediate", "delay:<duration>",
+// or "block".
+func parseOnDelete(value string) (onDelete, error) {
+	switch {
+	case value == "immediate":
+		return onDelete{}, nil
+	case value == "block":
+		return onDelete{block: true}, nil
+	case strings.HasPrefix(value, "delay:"):
+		delay, err := time.ParseDuration(strings.TrimPrefix(value, "delay:"))
+		if err != nil || delay < 0 {
+			return onDelete{}, fmt.Errorf("invalid ondelete delay '%s'", value)
+		}
+
+		return onDelete{delay: delay}, nil
+	}
+
+	return onDelete{}, fmt.Errorf("invalid ondelete '%s'", value)
+}
+
+// hasTesterDirectives returns true if any of the workflow's driver status
+// entries belong to the driver
+func hasTesterDirectives(workflow *dwsv1alpha2.Workflow) bool {
+	for _, driverStatus := range workflow.Status.Drivers {
+		if driverStatus.DriverID == DRIVERID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// workflowOnDelete combines the ondelete arguments of the workflow's tester
+// directives. A block by any directive blocks the workflow, and the longest
+// delay is used. Directives without an ondelete argument let the workflow go
+// immediately.
+func workflowOnDelete(workflow *dwsv1alpha2.Workflow) (onDelete, error) {
+	combined := onDelete{}
+	for _, driverStatus := range workflow.Status.Drivers {
+		if driverStatus.DriverID != DRIVERID {
+			continue
+		}
+
+		args, err := dwdparse.BuildArgsMap(workflow.Spec.DWDirectives[driverStatus.DWDIndex])
+		if err != nil {
+			return onDelete{}, err
+		}
+
+		value, found := args["ondelete"]
+		if !found {
+			continue
+		}
+
+		behavior, err := parseOnDelete(value)
+		if err != nil {
+			return onDelete{}, err
+		}
+
+		combined.block = combined.block || behavior.block
+		if behavior.delay > combined.delay {
+			combined.delay = behavior.delay
+		}
+	}
+
+	return combined, nil
+}
+
+// deletionHold returns why the driver is still holding a workflow that is
+// being deleted, along with the time until the hold should be checked again.
+// An empty reason means the workflow can go.
+func deletionHold(workflow *dwsv1alpha2.Workflow, behavior onDelete) (string, time.Duration) {
+	if behavior.block {
+		if _, found := workflow.GetAnnotations()[releaseAnnotation]; !found {
+			return "blocked until released", 0
+		}
+	}
+
+	if remaining := behavior.delay - time.Since(workflow.GetDeletionTimestamp().Time); remaining > 0 {
+		return "delayed", remaining
+	}
+
+	return "", 0
+}
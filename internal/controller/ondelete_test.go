@@ -0,0 +1,110 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("On Delete Test", func() {
+
+	var workflow *dwsv1alpha2.Workflow
+
+	BeforeEach(func() {
+		deleted := metav1.NewTime(time.Now())
+		workflow = &dwsv1alpha2.Workflow{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test",
+				DeletionTimestamp: &deleted,
+			},
+			Spec: dwsv1alpha2.WorkflowSpec{
+				DWDirectives: []string{
+					"#DW Proposal action=complete ondelete=delay:1m",
+					"#DW Setup action=complete ondelete=delay:10s",
+					"#DW jobdw type=xfs capacity=1GB name=other",
+				},
+			},
+			Status: dwsv1alpha2.WorkflowStatus{
+				Drivers: []dwsv1alpha2.WorkflowDriverStatus{
+					{DriverID: DRIVERID, DWDIndex: 0, WatchState: dwsv1alpha2.StateProposal},
+					{DriverID: DRIVERID, DWDIndex: 1, WatchState: dwsv1alpha2.StateSetup},
+					{DriverID: "other", DWDIndex: 2, WatchState: dwsv1alpha2.StateProposal},
+				},
+			},
+		}
+	})
+
+	DescribeTable("Parses ondelete arguments",
+		func(value string, expected onDelete, valid bool) {
+			behavior, err := parseOnDelete(value)
+			if !valid {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(behavior).To(Equal(expected))
+		},
+		Entry("immediate", "immediate", onDelete{}, true),
+		Entry("block", "block", onDelete{block: true}, true),
+		Entry("delay", "delay:30s", onDelete{delay: 30 * time.Second}, true),
+		Entry("bad delay", "delay:soon", onDelete{}, false),
+		Entry("unknown", "later", onDelete{}, false),
+	)
+
+	It("Finds tester directives", func() {
+		Expect(hasTesterDirectives(workflow)).To(BeTrue())
+
+		workflow.Status.Drivers = workflow.Status.Drivers[2:]
+		Expect(hasTesterDirectives(workflow)).To(BeFalse())
+	})
+
+	It("Holds the workflow for the longest delay", func() {
+		behavior, err := workflowOnDelete(workflow)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(behavior).To(Equal(onDelete{delay: time.Minute}))
+
+		reason, next := deletionHold(workflow, behavior)
+		Expect(reason).To(Equal("delayed"))
+		Expect(next).To(BeNumerically("~", time.Minute, time.Second))
+
+		workflow.DeletionTimestamp.Time = time.Now().Add(-2 * time.Minute)
+		reason, _ = deletionHold(workflow, behavior)
+		Expect(reason).To(BeEmpty())
+	})
+
+	It("Blocks the workflow until it is released", func() {
+		workflow.Spec.DWDirectives[1] = "#DW Setup action=complete ondelete=block"
+
+		behavior, err := workflowOnDelete(workflow)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(behavior.block).To(BeTrue())
+
+		reason, _ := deletionHold(workflow, onDelete{block: true})
+		Expect(reason).To(Equal("blocked until released"))
+
+		workflow.SetAnnotations(map[string]string{releaseAnnotation: "true"})
+		reason, _ = deletionHold(workflow, onDelete{block: true})
+		Expect(reason).To(BeEmpty())
+	})
+})
@@ -0,0 +1,191 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/workqueue"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// orphanedReason is the reason of the Events for orphaned resources
+const orphanedReason = "Orphaned"
+
+var orphanedResources = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "dws_tester_orphaned_resources_total",
+		Help: "Number of resources found with the labels of a workflow after the workflow was deleted.",
+	},
+	[]string{"kind"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(orphanedResources)
+}
+
+// orphanCheck is a deleted workflow whose children are to be checked
+type orphanCheck struct {
+	types.NamespacedName
+	uid types.UID
+}
+
+// OrphanChecker looks for resources that still carry the workflow or owner
+// labels of a workflow some time after the workflow was deleted. Each one
+// found is reported through an Event on the resource and the
+// dws_tester_orphaned_resources_total metric.
+type OrphanChecker struct {
+	client.Client
+	Log      logr.Logger
+	Recorder record.EventRecorder
+
+	// GracePeriod is how long after a workflow is deleted to check for its
+	// children
+	GracePeriod time.Duration
+
+	queue workqueue.DelayingInterface
+}
+
+// orphanListTypes are the types of resources that are checked for orphans
+var orphanListTypes = []client.ObjectList{
+	&dwsv1alpha2.ComputesList{},
+	&dwsv1alpha2.DirectiveBreakdownList{},
+	&dwsv1alpha2.ServersList{},
+	&dwsv1alpha2.ClientMountList{},
+	&dwsv1alpha2.PersistentStorageInstanceList{},
+}
+
+//+kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// NewOrphanChecker returns an orphan checker that is ready to be added to the
+// manager
+func NewOrphanChecker(c client.Client, log logr.Logger, recorder record.EventRecorder, gracePeriod time.Duration) *OrphanChecker {
+	return &OrphanChecker{
+		Client:      c,
+		Log:         log,
+		Recorder:    recorder,
+		GracePeriod: gracePeriod,
+		queue:       workqueue.NewDelayingQueue(),
+	}
+}
+
+// schedule checks for the children of a workflow that is being deleted once
+// the grace period has passed. Does nothing for a nil checker.
+func (o *OrphanChecker) schedule(workflow *dwsv1alpha2.Workflow) {
+	if o == nil {
+		return
+	}
+
+	o.queue.AddAfter(orphanCheck{NamespacedName: client.ObjectKeyFromObject(workflow), uid: workflow.GetUID()}, o.GracePeriod)
+}
+
+// Start runs the checks as they come due until the context is done
+func (o *OrphanChecker) Start(ctx context.Context) error {
+	go func() {
+		<-ctx.Done()
+		o.queue.ShutDown()
+	}()
+
+	for {
+		item, shutdown := o.queue.Get()
+		if shutdown {
+			return nil
+		}
+
+		check := item.(orphanCheck)
+		if err := o.check(ctx, check); err != nil {
+			o.Log.Error(err, "Could not check for orphaned resources", "Workflow", check.NamespacedName)
+		}
+
+		o.queue.Done(item)
+	}
+}
+
+// check reports the resources left behind by a deleted workflow. A workflow
+// that is still being deleted is checked again after another grace period.
+func (o *OrphanChecker) check(ctx context.Context, check orphanCheck) error {
+	workflow := &dwsv1alpha2.Workflow{}
+	err := o.Get(ctx, check.NamespacedName, workflow)
+	if err == nil && workflow.GetUID() == check.uid {
+		o.queue.AddAfter(check, o.GracePeriod)
+		return nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	selectors := []client.MatchingLabels{
+		{
+			dwsv1alpha2.WorkflowNameLabel:      check.Name,
+			dwsv1alpha2.WorkflowNamespaceLabel: check.Namespace,
+		},
+		{
+			dwsv1alpha2.OwnerKindLabel:      reflect.TypeOf(dwsv1alpha2.Workflow{}).Name(),
+			dwsv1alpha2.OwnerNameLabel:      check.Name,
+			dwsv1alpha2.OwnerNamespaceLabel: check.Namespace,
+		},
+	}
+
+	for _, listType := range orphanListTypes {
+		reported := map[types.UID]bool{}
+
+		for _, selector := range selectors {
+			list := listType.DeepCopyObject().(client.ObjectList)
+			if err := o.List(ctx, list, selector); err != nil {
+				return err
+			}
+
+			items, err := meta.ExtractList(list)
+			if err != nil {
+				return err
+			}
+
+			for _, item := range items {
+				object := item.(client.Object)
+				if reported[object.GetUID()] {
+					continue
+				}
+				reported[object.GetUID()] = true
+
+				o.report(object, check)
+			}
+		}
+	}
+
+	return nil
+}
+
+// report records an orphaned resource
+func (o *OrphanChecker) report(object client.Object, check orphanCheck) {
+	kind := reflect.TypeOf(object).Elem().Name()
+
+	o.Log.Info("Found orphaned resource", "kind", kind, "name", client.ObjectKeyFromObject(object), "Workflow", check.NamespacedName)
+	o.Recorder.Eventf(object, corev1.EventTypeWarning, orphanedReason,
+		"%s outlived workflow %s by more than %s", kind, check.NamespacedName, o.GracePeriod)
+	orphanedResources.WithLabelValues(kind).Inc()
+}
@@ -0,0 +1,58 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Orphan Checker Test", func() {
+
+	orphanedCount := func(kind string) float64 {
+		metric := &dto.Metric{}
+		Expect(orphanedResources.WithLabelValues(kind).Write(metric)).To(Succeed())
+		return metric.GetCounter().GetValue()
+	}
+
+	It("Ignores workflows without a checker", func() {
+		var orphans *OrphanChecker
+		orphans.schedule(&dwsv1alpha2.Workflow{})
+	})
+
+	It("Reports orphaned resources through Events and metrics", func() {
+		recorder := record.NewFakeRecorder(1)
+		orphans := NewOrphanChecker(nil, logr.Discard(), recorder, time.Minute)
+
+		servers := &dwsv1alpha2.Servers{ObjectMeta: metav1.ObjectMeta{Name: "test-0", Namespace: "default"}}
+		before := orphanedCount("Servers")
+
+		orphans.report(servers, orphanCheck{NamespacedName: types.NamespacedName{Name: "test", Namespace: "default"}})
+
+		Expect(recorder.Events).To(Receive(Equal("Warning Orphaned Servers outlived workflow default/test by more than 1m0s")))
+		Expect(orphanedCount("Servers")).To(Equal(before + 1))
+	})
+})
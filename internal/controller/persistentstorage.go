@@ -0,0 +1,396 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// createPersistentDirective handles the create_persistent directive. Proposal
+// creates the PersistentStorageInstance along with its DirectiveBreakdown and
+// Servers resources, and Setup makes it Active once its allocations are ready.
+// Teardown releases an Active instance from the workflow so that it outlives
+// the job, and destroys one that never became Active. Returns true once the
+// driver status has reached a final result for the state.
+func (r *WorkflowReconciler) createPersistentDirective(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) (bool, error) {
+	switch workflow.Spec.DesiredState {
+	case dwsv1alpha2.StateProposal:
+		psi, err := r.createPersistentStorage(ctx, workflow, driverStatus, args)
+		if resErr, ok := err.(*dwsv1alpha2.ResourceErrorInfo); ok {
+			setDriverError(driverStatus, resErr)
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+
+		return r.createBreakdown(ctx, workflow, driverStatus, args, psi)
+
+	case dwsv1alpha2.StateSetup:
+		done, err := r.waitForAllocations(ctx, workflow, driverStatus, args["name"], workflow.Namespace)
+		if err != nil || !driverStatus.Completed {
+			return done, err
+		}
+
+		psi, resErr := r.getPersistentStorage(ctx, args["name"], workflow.Namespace)
+		if resErr != nil {
+			setDriverError(driverStatus, resErr)
+			return resErr.Severity == dwsv1alpha2.SeverityFatal, nil
+		}
+
+		return true, r.setPersistentStorageState(ctx, psi, dwsv1alpha2.PSIStateActive)
+
+	case dwsv1alpha2.StateTeardown:
+		released, err := r.releasePersistentStorage(ctx, workflow, args["name"])
+		if err != nil {
+			return false, err
+		}
+
+		if !released {
+			driverStatus.Status = dwsv1alpha2.StatusRunning
+			return false, nil
+		}
+
+		return r.deleteBreakdowns(ctx, workflow, driverStatus)
+	}
+
+	completeDriverStatus(driverStatus)
+	return true, nil
+}
+
+// persistentdwDirective handles the persistentdw directive. Proposal adds the
+// workflow to the consumers of the PersistentStorageInstance, Setup waits for
+// the instance to be Active, and Teardown removes the workflow from the
+// consumers. Returns true once the driver status has reached a final result
+// for the state.
+func (r *WorkflowReconciler) persistentdwDirective(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) (bool, error) {
+	consumer := corev1.ObjectReference{
+		Kind:      reflect.TypeOf(dwsv1alpha2.Workflow{}).Name(),
+		Name:      workflow.Name,
+		Namespace: workflow.Namespace,
+		UID:       workflow.UID,
+	}
+
+	psi, resErr := r.getPersistentStorage(ctx, args["name"], workflow.Namespace)
+
+	switch workflow.Spec.DesiredState {
+	case dwsv1alpha2.StateProposal:
+		if resErr != nil {
+			setDriverError(driverStatus, resErr)
+			return resErr.Severity == dwsv1alpha2.SeverityFatal, nil
+		}
+
+		if psi.Spec.State == dwsv1alpha2.PSIStateDestroying {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("persistent storage instance '%s' is being destroyed", psi.Name).
+				WithUserMessage("persistent storage '%s' is being destroyed", psi.Name).WithUser().WithFatal())
+			return true, nil
+		}
+
+		if findConsumer(psi, consumer) == -1 {
+			psi.Spec.ConsumerReferences = append(psi.Spec.ConsumerReferences, consumer)
+			if err := r.Update(ctx, psi); err != nil {
+				return false, err
+			}
+		}
+
+	case dwsv1alpha2.StateSetup:
+		if resErr != nil {
+			setDriverError(driverStatus, resErr)
+			return resErr.Severity == dwsv1alpha2.SeverityFatal, nil
+		}
+
+		if psi.Status.State != dwsv1alpha2.PSIStateActive {
+			driverStatus.Status = dwsv1alpha2.StatusRunning
+			driverStatus.Message = "Waiting for persistent storage '" + psi.Name + "'"
+			return false, nil
+		}
+
+	case dwsv1alpha2.StateTeardown:
+		// There's nothing left to release if the instance is gone
+		if resErr != nil {
+			if resErr.Severity != dwsv1alpha2.SeverityFatal {
+				setDriverError(driverStatus, resErr)
+				return false, nil
+			}
+			break
+		}
+
+		if index := findConsumer(psi, consumer); index != -1 {
+			psi.Spec.ConsumerReferences = append(psi.Spec.ConsumerReferences[:index], psi.Spec.ConsumerReferences[index+1:]...)
+			if err := r.Update(ctx, psi); err != nil {
+				return false, err
+			}
+		}
+	}
+
+	completeDriverStatus(driverStatus)
+	return true, nil
+}
+
+// destroyPersistentDirective handles the destroy_persistent directive.
+// Proposal checks that the PersistentStorageInstance belongs to the user and
+// has no consumers, and marks it as Destroying so that no more can be added.
+// Teardown deletes it along with its Servers resource. Returns true once the
+// driver status has reached a final result for the state.
+func (r *WorkflowReconciler) destroyPersistentDirective(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) (bool, error) {
+	psi, resErr := r.getPersistentStorage(ctx, args["name"], workflow.Namespace)
+
+	switch workflow.Spec.DesiredState {
+	case dwsv1alpha2.StateProposal:
+		if resErr != nil {
+			setDriverError(driverStatus, resErr)
+			return resErr.Severity == dwsv1alpha2.SeverityFatal, nil
+		}
+
+		if psi.Spec.UserID != workflow.Spec.UserID {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("persistent storage instance '%s' belongs to user %d", psi.Name, psi.Spec.UserID).
+				WithUserMessage("persistent storage '%s' belongs to another user", psi.Name).WithUser().WithFatal())
+			return true, nil
+		}
+
+		if resErr := persistentStorageInUse(psi); resErr != nil {
+			setDriverError(driverStatus, resErr)
+			return true, nil
+		}
+
+		if psi.Spec.State != dwsv1alpha2.PSIStateDestroying {
+			psi.Spec.State = dwsv1alpha2.PSIStateDestroying
+			if err := r.Update(ctx, psi); err != nil {
+				return false, err
+			}
+		}
+
+		if err := r.setPersistentStorageState(ctx, psi, dwsv1alpha2.PSIStateDestroying); err != nil {
+			return false, err
+		}
+
+	case dwsv1alpha2.StateTeardown:
+		// The instance is already gone
+		if resErr != nil {
+			if resErr.Severity != dwsv1alpha2.SeverityFatal {
+				setDriverError(driverStatus, resErr)
+				return false, nil
+			}
+			break
+		}
+
+		if resErr := persistentStorageInUse(psi); resErr != nil {
+			setDriverError(driverStatus, resErr)
+			return true, nil
+		}
+
+		deleted, err := r.deletePersistentStorage(ctx, psi)
+		if err != nil {
+			return false, err
+		}
+
+		if !deleted {
+			driverStatus.Status = dwsv1alpha2.StatusRunning
+			return false, nil
+		}
+	}
+
+	completeDriverStatus(driverStatus)
+	return true, nil
+}
+
+// createPersistentStorage creates the PersistentStorageInstance for a
+// create_persistent directive. The instance belongs to the workflow until the
+// workflow's Teardown releases it. Returns a user error if another instance
+// already has the name.
+func (r *WorkflowReconciler) createPersistentStorage(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) (*dwsv1alpha2.PersistentStorageInstance, error) {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow), "index", driverStatus.DWDIndex)
+
+	psi := &dwsv1alpha2.PersistentStorageInstance{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      args["name"],
+			Namespace: workflow.Namespace,
+		},
+	}
+
+	if err := r.Get(ctx, client.ObjectKeyFromObject(psi), psi); err == nil {
+		if psi.GetLabels()[dwsv1alpha2.WorkflowNameLabel] != workflow.Name {
+			return nil, dwsv1alpha2.NewResourceError("persistent storage instance '%s' already exists", psi.Name).
+				WithUserMessage("persistent storage '%s' already exists", psi.Name).WithUser().WithFatal()
+		}
+	} else if !apierrors.IsNotFound(err) {
+		return nil, err
+	}
+
+	result, err := ctrl.CreateOrUpdate(ctx, r.Client, psi,
+		func() error {
+			dwsv1alpha2.AddWorkflowLabels(psi, workflow)
+			dwsv1alpha2.AddOwnerLabels(psi, workflow)
+			addDriverLabel(psi)
+
+			psi.Spec.Name = args["name"]
+			psi.Spec.FsType = args["type"]
+			psi.Spec.DWDirective = workflow.Spec.DWDirectives[driverStatus.DWDIndex]
+			psi.Spec.UserID = workflow.Spec.UserID
+
+			// A destroy_persistent directive may have moved the instance on
+			// since it was created
+			if psi.CreationTimestamp.IsZero() {
+				psi.Spec.State = dwsv1alpha2.PSIStateActive
+			}
+
+			return ctrl.SetControllerReference(workflow, psi, r.Scheme)
+		})
+	if err != nil {
+		log.Error(err, "Failed to create or update PersistentStorageInstance", "name", psi.Name)
+		return nil, err
+	}
+	if result == controllerutil.OperationResultCreated {
+		log.Info("Created PersistentStorageInstance", "name", psi.Name)
+	}
+
+	if psi.Status.State == "" {
+		psi.Status.Servers = corev1.ObjectReference{
+			Kind:      reflect.TypeOf(dwsv1alpha2.Servers{}).Name(),
+			Name:      psi.Name,
+			Namespace: psi.Namespace,
+		}
+
+		if err := r.setPersistentStorageState(ctx, psi, dwsv1alpha2.PSIStateCreating); err != nil {
+			return nil, err
+		}
+	}
+
+	return psi, nil
+}
+
+// getPersistentStorage returns the PersistentStorageInstance with the given
+// name, or a user error if there isn't one
+func (r *WorkflowReconciler) getPersistentStorage(ctx context.Context, name string, namespace string) (*dwsv1alpha2.PersistentStorageInstance, *dwsv1alpha2.ResourceErrorInfo) {
+	psi := &dwsv1alpha2.PersistentStorageInstance{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, psi); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, dwsv1alpha2.NewResourceError("persistent storage instance '%s' not found", name).
+				WithUserMessage("persistent storage '%s' not found", name).WithUser().WithFatal()
+		}
+
+		return nil, dwsv1alpha2.NewResourceError("could not get persistent storage instance '%s'", name).WithError(err).WithMajor()
+	}
+
+	return psi, nil
+}
+
+// setPersistentStorageState moves the PersistentStorageInstance to a state
+func (r *WorkflowReconciler) setPersistentStorageState(ctx context.Context, psi *dwsv1alpha2.PersistentStorageInstance, state dwsv1alpha2.PersistentStorageInstanceState) error {
+	if psi.Status.State == state {
+		return nil
+	}
+
+	r.Log.Info("Changing PersistentStorageInstance state", "name", psi.Name, "from", psi.Status.State, "to", state)
+	psi.Status.State = state
+
+	return r.Status().Update(ctx, psi)
+}
+
+// releasePersistentStorage releases the PersistentStorageInstance of a
+// create_persistent directive from the workflow. An Active instance is
+// detached from the workflow so that it outlives the job, and any other
+// instance is deleted. Returns true once the instance has been released.
+func (r *WorkflowReconciler) releasePersistentStorage(ctx context.Context, workflow *dwsv1alpha2.Workflow, name string) (bool, error) {
+	psi := &dwsv1alpha2.PersistentStorageInstance{}
+	if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: workflow.Namespace}, psi); err != nil {
+		return apierrors.IsNotFound(err), client.IgnoreNotFound(err)
+	}
+
+	// Someone else's instance with the same name
+	if psi.GetLabels()[dwsv1alpha2.WorkflowNameLabel] != workflow.Name {
+		return true, nil
+	}
+
+	if psi.Status.State != dwsv1alpha2.PSIStateActive {
+		return r.deletePersistentStorage(ctx, psi)
+	}
+
+	labels := psi.GetLabels()
+	delete(labels, dwsv1alpha2.WorkflowNameLabel)
+	delete(labels, dwsv1alpha2.WorkflowNamespaceLabel)
+	psi.SetLabels(labels)
+	dwsv1alpha2.RemoveOwnerLabels(psi)
+	psi.SetOwnerReferences(nil)
+
+	r.Log.Info("Releasing PersistentStorageInstance from workflow", "name", psi.Name, "workflow", workflow.Name)
+	if err := r.Update(ctx, psi); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// deletePersistentStorage deletes the PersistentStorageInstance after its
+// Servers resource. Returns true once both are gone.
+func (r *WorkflowReconciler) deletePersistentStorage(ctx context.Context, psi *dwsv1alpha2.PersistentStorageInstance) (bool, error) {
+	matchingLabels := dwsv1alpha2.MatchingPersistentStorage(psi)
+	matchingLabels[driverLabel] = DRIVERID
+
+	servers := &dwsv1alpha2.ServersList{}
+	if err := r.List(ctx, servers, client.InNamespace(psi.Namespace), matchingLabels); err != nil {
+		return false, err
+	}
+
+	if len(servers.Items) > 0 {
+		if err := r.DeleteAllOf(ctx, &dwsv1alpha2.Servers{}, client.InNamespace(psi.Namespace), matchingLabels); err != nil {
+			return false, err
+		}
+
+		return false, nil
+	}
+
+	if err := r.Delete(ctx, psi); err != nil {
+		return apierrors.IsNotFound(err), client.IgnoreNotFound(err)
+	}
+
+	r.Log.Info("Deleted PersistentStorageInstance", "name", psi.Name)
+	return false, nil
+}
+
+// findConsumer returns the index of the consumer in the consumer references of
+// the PersistentStorageInstance, or -1 if it isn't there
+func findConsumer(psi *dwsv1alpha2.PersistentStorageInstance, consumer corev1.ObjectReference) int {
+	for index, reference := range psi.Spec.ConsumerReferences {
+		if reference == consumer {
+			return index
+		}
+	}
+
+	return -1
+}
+
+// persistentStorageInUse returns a user error if the PersistentStorageInstance
+// has consumers
+func persistentStorageInUse(psi *dwsv1alpha2.PersistentStorageInstance) *dwsv1alpha2.ResourceErrorInfo {
+	if len(psi.Spec.ConsumerReferences) == 0 {
+		return nil
+	}
+
+	return dwsv1alpha2.NewResourceError("persistent storage instance '%s' has %d consumers", psi.Name, len(psi.Spec.ConsumerReferences)).
+		WithUserMessage("persistent storage '%s' is in use by %d jobs", psi.Name, len(psi.Spec.ConsumerReferences)).WithUser().WithFatal()
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Persistent Storage Test", func() {
+
+	var psi *dwsv1alpha2.PersistentStorageInstance
+
+	consumer := func(name string) corev1.ObjectReference {
+		return corev1.ObjectReference{Kind: "Workflow", Name: name, Namespace: corev1.NamespaceDefault}
+	}
+
+	BeforeEach(func() {
+		psi = &dwsv1alpha2.PersistentStorageInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: "scratch", Namespace: corev1.NamespaceDefault},
+		}
+	})
+
+	It("Finds consumers", func() {
+		psi.Spec.ConsumerReferences = []corev1.ObjectReference{consumer("job-1"), consumer("job-2")}
+
+		Expect(findConsumer(psi, consumer("job-2"))).To(Equal(1))
+		Expect(findConsumer(psi, consumer("job-3"))).To(Equal(-1))
+	})
+
+	It("Allows destroying instances without consumers", func() {
+		Expect(persistentStorageInUse(psi)).To(BeNil())
+	})
+
+	It("Refuses to destroy instances with consumers", func() {
+		psi.Spec.ConsumerReferences = []corev1.ObjectReference{consumer("job-1")}
+
+		resErr := persistentStorageInUse(psi)
+		Expect(resErr).ToNot(BeNil())
+		Expect(resErr.Type).To(Equal(dwsv1alpha2.TypeUser))
+		Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+		Expect(resErr.UserMessage).To(Equal("persistent storage 'scratch' is in use by 1 jobs"))
+	})
+})
+
+var _ = Describe("Persistent Storage Reconciler Test", func() {
+
+	var psi *dwsv1alpha2.PersistentStorageInstance
+
+	BeforeEach(func() {
+		psi = &dwsv1alpha2.PersistentStorageInstance{
+			ObjectMeta: metav1.ObjectMeta{Name: "psi-" + uuid.NewString()[0:8], Namespace: corev1.NamespaceDefault},
+		}
+	})
+
+	createWorkflow := func(directive string) *dwsv1alpha2.Workflow {
+		workflow := &dwsv1alpha2.Workflow{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "persistent-" + uuid.NewString()[0:8],
+				Namespace: corev1.NamespaceDefault,
+			},
+			Spec: dwsv1alpha2.WorkflowSpec{
+				DesiredState: dwsv1alpha2.StateProposal,
+				WLMID:        "test",
+				JobID:        intstr.FromString("wlm job 442"),
+				DWDirectives: []string{directive},
+			},
+		}
+
+		Expect(k8sClient.Create(context.TODO(), workflow)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(k8sClient.Delete(context.TODO(), workflow)).To(Succeed())
+			Eventually(func() error {
+				return k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(workflow), workflow)
+			}).ShouldNot(Succeed())
+		})
+
+		return workflow
+	}
+
+	// driverStatus returns the tester entry of the workflow for a state
+	driverStatus := func(workflow *dwsv1alpha2.Workflow, state dwsv1alpha2.WorkflowState) func(Gomega) dwsv1alpha2.WorkflowDriverStatus {
+		return func(g Gomega) dwsv1alpha2.WorkflowDriverStatus {
+			g.Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(workflow), workflow)).To(Succeed())
+			for _, driverStatus := range workflow.Status.Drivers {
+				if driverStatus.DriverID == DRIVERID && driverStatus.WatchState == state {
+					return driverStatus
+				}
+			}
+
+			return dwsv1alpha2.WorkflowDriverStatus{}
+		}
+	}
+
+	moveToTeardown := func(workflow *dwsv1alpha2.Workflow) {
+		Eventually(func() error {
+			Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(workflow), workflow)).To(Succeed())
+			workflow.Spec.DesiredState = dwsv1alpha2.StateTeardown
+			return k8sClient.Update(context.TODO(), workflow)
+		}).Should(Succeed())
+	}
+
+	getPSI := func() *dwsv1alpha2.PersistentStorageInstance {
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(psi), psi)).To(Succeed())
+		return psi
+	}
+
+	It("Creates, consumes, and destroys persistent storage", func() {
+		creator := createWorkflow("#DW create_persistent type=xfs capacity=1GiB name=" + psi.Name)
+		Eventually(driverStatus(creator, dwsv1alpha2.StateProposal)).Should(HaveField("Completed", BeTrue()))
+		Expect(getPSI().Spec.State).To(Equal(dwsv1alpha2.PSIStateActive))
+		Expect(psi.Status.State).To(Equal(dwsv1alpha2.PSIStateCreating))
+
+		consumer := createWorkflow("#DW persistentdw name=" + psi.Name)
+		Eventually(driverStatus(consumer, dwsv1alpha2.StateProposal)).Should(HaveField("Completed", BeTrue()))
+		Expect(getPSI().Spec.ConsumerReferences).To(HaveLen(1))
+		Expect(psi.Spec.ConsumerReferences[0].Name).To(Equal(consumer.Name))
+
+		// The instance can't be destroyed while a job uses it
+		refused := createWorkflow("#DW destroy_persistent name=" + psi.Name)
+		Eventually(driverStatus(refused, dwsv1alpha2.StateProposal)).Should(And(
+			HaveField("Status", dwsv1alpha2.StatusError),
+			HaveField("Message", ContainSubstring("persistent storage '"+psi.Name+"' is in use by 1 jobs")),
+		))
+		Expect(getPSI().Spec.State).To(Equal(dwsv1alpha2.PSIStateActive))
+
+		moveToTeardown(consumer)
+		Eventually(driverStatus(consumer, dwsv1alpha2.StateTeardown)).Should(HaveField("Completed", BeTrue()))
+		Expect(getPSI().Spec.ConsumerReferences).To(BeEmpty())
+
+		destroyer := createWorkflow("#DW destroy_persistent name=" + psi.Name)
+		Eventually(driverStatus(destroyer, dwsv1alpha2.StateProposal)).Should(HaveField("Completed", BeTrue()))
+		Expect(getPSI().Spec.State).To(Equal(dwsv1alpha2.PSIStateDestroying))
+		Expect(psi.Status.State).To(Equal(dwsv1alpha2.PSIStateDestroying))
+
+		// Reconciling the creator again leaves the instance Destroying
+		Eventually(func() error {
+			Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(creator), creator)).To(Succeed())
+			creator.SetAnnotations(map[string]string{"test": "touched"})
+			return k8sClient.Update(context.TODO(), creator)
+		}).Should(Succeed())
+		Consistently(func() dwsv1alpha2.PersistentStorageInstanceState {
+			return getPSI().Spec.State
+		}).Should(Equal(dwsv1alpha2.PSIStateDestroying))
+
+		moveToTeardown(destroyer)
+		Eventually(driverStatus(destroyer, dwsv1alpha2.StateTeardown)).WithTimeout(20 * time.Second).Should(HaveField("Completed", BeTrue()))
+		Expect(apierrors.IsNotFound(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(psi), psi))).To(BeTrue())
+	})
+})
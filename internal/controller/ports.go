@@ -0,0 +1,253 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// portAnnotationPrefix is the prefix of the workflow annotation that records
+// the port allocated for the directive with the given index
+const portAnnotationPrefix = testerDomain + "port-"
+
+// portRetryInterval is how often a directive waiting for a free port checks
+// the pool again
+const portRetryInterval = 2 * time.Second
+
+// expandPorts returns every port in the ports of a SystemConfiguration, which
+// are single ports or ranges of the form "START-END"
+func expandPorts(ports []intstr.IntOrString) ([]int, error) {
+	expanded := []int{}
+	for _, port := range ports {
+		value, err := parsePorts(port.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if value.Type == intstr.Int {
+			expanded = append(expanded, value.IntValue())
+			continue
+		}
+
+		first, last, _ := strings.Cut(value.StrVal, "-")
+		start, _ := strconv.Atoi(first)
+		end, _ := strconv.Atoi(last)
+		for p := start; p <= end; p++ {
+			expanded = append(expanded, p)
+		}
+	}
+
+	return expanded, nil
+}
+
+// portAllocation identifies the directive that a port is allocated to
+type portAllocation struct {
+	uid   types.UID
+	index int
+}
+
+// portTracker keeps track of the ports allocated to workflows and of the
+// ports that were released recently enough to still be cooling down.
+type portTracker struct {
+	sync.Mutex
+	loaded    bool
+	allocated map[int]portAllocation
+	released  map[int]time.Time
+}
+
+func newPortTracker() *portTracker {
+	return &portTracker{
+		allocated: map[int]portAllocation{},
+		released:  map[int]time.Time{},
+	}
+}
+
+// load rebuilds the allocations from the port annotations of the workflows
+// the first time it is called, so that a restarted driver doesn't hand out
+// ports that are still in use. Workflows in teardown have released their
+// ports. The cooldown of ports released before the restart is lost.
+func (t *portTracker) load(ctx context.Context, c client.Client) error {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.loaded {
+		return nil
+	}
+
+	workflows := &dwsv1alpha2.WorkflowList{}
+	if err := c.List(ctx, workflows); err != nil {
+		return err
+	}
+
+	for _, workflow := range workflows.Items {
+		if workflow.Spec.DesiredState == dwsv1alpha2.StateTeardown || !workflow.GetDeletionTimestamp().IsZero() {
+			continue
+		}
+
+		for key, value := range workflow.GetAnnotations() {
+			if !strings.HasPrefix(key, portAnnotationPrefix) {
+				continue
+			}
+
+			index, err := strconv.Atoi(strings.TrimPrefix(key, portAnnotationPrefix))
+			if err != nil {
+				continue
+			}
+
+			if port, err := strconv.Atoi(value); err == nil {
+				t.allocated[port] = portAllocation{uid: workflow.GetUID(), index: index}
+			}
+		}
+	}
+
+	t.loaded = true
+	return nil
+}
+
+// allocate returns the port allocated to a directive, allocating the first
+// free port in the pool if it doesn't have one. A port is free if it isn't
+// allocated and was released at least the cooldown ago. Returns false if every
+// port in the pool is in use or cooling down.
+func (t *portTracker) allocate(uid types.UID, index int, pool []int, cooldown time.Duration) (int, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	owner := portAllocation{uid: uid, index: index}
+	for port, allocation := range t.allocated {
+		if allocation == owner {
+			return port, true
+		}
+	}
+
+	for _, port := range pool {
+		if _, found := t.allocated[port]; found {
+			continue
+		}
+
+		if released, found := t.released[port]; found && time.Since(released) < cooldown {
+			continue
+		}
+
+		delete(t.released, port)
+		t.allocated[port] = owner
+		return port, true
+	}
+
+	return 0, false
+}
+
+// release frees the ports allocated to a workflow and starts their cooldown.
+// Returns the ports that were released.
+func (t *portTracker) release(uid types.UID) []int {
+	t.Lock()
+	defer t.Unlock()
+
+	ports := []int{}
+	for port, allocation := range t.allocated {
+		if allocation.uid != uid {
+			continue
+		}
+
+		delete(t.allocated, port)
+		t.released[port] = time.Now()
+		ports = append(ports, port)
+	}
+
+	return ports
+}
+
+// portAction allocates a port from the SystemConfiguration for the life of the
+// workflow and records it in a workflow annotation. The port is released when
+// the workflow reaches Teardown. When the pool is exhausted the directive
+// waits for a port, or reports an error if the severity argument is given.
+// Returns the time until the pool should be checked again, or zero once the
+// driver status has reached a final result.
+func (r *WorkflowReconciler) portAction(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) (time.Duration, error) {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow), "index", driverStatus.DWDIndex)
+
+	severity := dwsv1alpha2.ResourceErrorSeverity("")
+	if value, found := args["severity"]; found {
+		var err error
+		if severity, err = ParseSeverity(value); err != nil {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("").WithError(err).
+				WithUserMessage("invalid 'severity' argument '%s'", value).WithUser().WithFatal())
+			return 0, nil
+		}
+	}
+
+	systemConfiguration := &dwsv1alpha2.SystemConfiguration{}
+	if err := r.Get(ctx, systemConfigurationName, systemConfiguration); err != nil {
+		setDriverError(driverStatus, dwsv1alpha2.NewResourceError("could not get SystemConfiguration %v", systemConfigurationName).
+			WithError(err).WithMajor())
+		return resourceErrorRetryInterval, nil
+	}
+
+	pool, err := expandPorts(systemConfiguration.Spec.Ports)
+	if err != nil {
+		setDriverError(driverStatus, dwsv1alpha2.NewResourceError("invalid ports in SystemConfiguration %v", systemConfigurationName).
+			WithError(err).WithFatal())
+		return 0, nil
+	}
+
+	if err := r.ports.load(ctx, r.Client); err != nil {
+		return 0, err
+	}
+
+	cooldown := time.Duration(systemConfiguration.Spec.PortsCooldownInSeconds) * time.Second
+	port, ok := r.ports.allocate(workflow.GetUID(), driverStatus.DWDIndex, pool, cooldown)
+	if !ok {
+		if severity == "" {
+			driverStatus.Status = dwsv1alpha2.StatusRunning
+			driverStatus.Message = "Waiting for a free port"
+			driverStatus.Error = ""
+			return portRetryInterval, nil
+		}
+
+		resErr := dwsv1alpha2.NewResourceError("no free ports among %d ports", len(pool)).
+			WithUserMessage("no free ports")
+		resErr.Severity = severity
+		setDriverError(driverStatus, resErr)
+		if severity == dwsv1alpha2.SeverityFatal {
+			return 0, nil
+		}
+
+		return resourceErrorRetryInterval, nil
+	}
+
+	annotations := workflow.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[portAnnotationPrefix+strconv.Itoa(driverStatus.DWDIndex)] = strconv.Itoa(port)
+	workflow.SetAnnotations(annotations)
+
+	log.Info("Allocated port", "port", port)
+	completeDriverStatus(driverStatus)
+	driverStatus.Message = fmt.Sprintf("Allocated port %d", port)
+
+	return 0, nil
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+var _ = Describe("Port Allocation Test", func() {
+
+	It("Expands ports and port ranges", func() {
+		ports, err := expandPorts([]intstr.IntOrString{intstr.FromString("6000-6002"), intstr.FromInt(7000), intstr.FromString("8000")})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(ports).To(Equal([]int{6000, 6001, 6002, 7000, 8000}))
+
+		_, err = expandPorts([]intstr.IntOrString{intstr.FromString("6002-6000")})
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Allocates each port once", func() {
+		tracker := newPortTracker()
+		pool := []int{6000, 6001}
+
+		port, ok := tracker.allocate(types.UID("a"), 0, pool, 0)
+		Expect(ok).To(BeTrue())
+		Expect(port).To(Equal(6000))
+
+		// The same directive keeps its port
+		port, ok = tracker.allocate(types.UID("a"), 0, pool, 0)
+		Expect(ok).To(BeTrue())
+		Expect(port).To(Equal(6000))
+
+		port, ok = tracker.allocate(types.UID("b"), 0, pool, 0)
+		Expect(ok).To(BeTrue())
+		Expect(port).To(Equal(6001))
+
+		_, ok = tracker.allocate(types.UID("c"), 0, pool, 0)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("Holds released ports for the cooldown", func() {
+		tracker := newPortTracker()
+		pool := []int{6000}
+
+		_, ok := tracker.allocate(types.UID("a"), 0, pool, time.Hour)
+		Expect(ok).To(BeTrue())
+		Expect(tracker.release(types.UID("a"))).To(Equal([]int{6000}))
+
+		_, ok = tracker.allocate(types.UID("b"), 0, pool, time.Hour)
+		Expect(ok).To(BeFalse())
+
+		tracker.released[6000] = time.Now().Add(-time.Hour)
+		port, ok := tracker.allocate(types.UID("b"), 0, pool, time.Hour)
+		Expect(ok).To(BeTrue())
+		Expect(port).To(Equal(6000))
+	})
+})
@@ -0,0 +1,277 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	dwdparse "github.com/DataWorkflowServices/dws/utils/dwdparse"
+	"github.com/DataWorkflowServices/dws/utils/updater"
+	"github.com/go-logr/logr"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// ServersReconciler fills in the status of the Servers resources that the
+// driver created for storage directives, playing the part of the storage that
+// would hold the allocations.
+type ServersReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// CapacitySeverity is the severity of the errors for allocations that are
+	// larger than the free capacity of a storage node
+	CapacitySeverity dwsv1alpha2.ResourceErrorSeverity
+}
+
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=servers,verbs=get;list;watch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=servers/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=directivebreakdowns,verbs=get;list;watch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=persistentstorageinstances,verbs=get;list;watch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=storages,verbs=get;list;watch
+
+// Reconcile reports an allocation on each storage that the WLM placed in the
+// Servers resource, unless the placement breaks the constraints of the
+// directive, the directive asked for the allocation to fail, or the storage
+// doesn't have the free capacity for it.
+func (r *ServersReconciler) Reconcile(ctx context.Context, req ctrl.Request) (res ctrl.Result, err error) {
+	log := r.Log.WithValues("Servers", req.NamespacedName)
+
+	servers := &dwsv1alpha2.Servers{}
+	if err := r.Get(ctx, req.NamespacedName, servers); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !servers.GetDeletionTimestamp().IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	// Wait for the WLM to place the allocations
+	if len(servers.Spec.AllocationSets) == 0 {
+		return ctrl.Result{}, nil
+	}
+
+	statusUpdater := updater.NewStatusUpdater[*dwsv1alpha2.ServersStatus](servers)
+	defer func() { err = statusUpdater.CloseWithStatusUpdate(ctx, r.Client.Status(), err) }()
+
+	args, err := r.directiveArgs(ctx, servers)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	ledger, err := loadCapacityLedger(ctx, r.Client, servers.GetUID())
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status := servers.Status.DeepCopy()
+	status.AllocationSets = []dwsv1alpha2.ServersStatusAllocationSet{}
+
+	// Allocations placed against the constraints of the directive aren't made
+	status.Error, err = r.validatePlacement(ctx, servers)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if status.Error == nil {
+		status.AllocationSets, status.Error = allocateServers(servers, args, ledger, r.CapacitySeverity)
+	}
+
+	status.Ready = status.Error == nil
+
+	if !reflect.DeepEqual(servers.Status, *status) {
+		if status.Error != nil {
+			log.Info("Failing allocation", "error", status.Error.Error())
+		} else {
+			log.Info("Allocations ready")
+		}
+
+		now := metav1.NowMicro()
+		status.LastUpdate = &now
+		servers.Status = *status
+	}
+
+	// Capacity may be freed by other allocations
+	if status.Error != nil && status.Error.Severity != dwsv1alpha2.SeverityFatal {
+		return ctrl.Result{RequeueAfter: resourceErrorRetryInterval}, nil
+	}
+
+	return ctrl.Result{}, nil
+}
+
+// allocateServers makes the allocations placed in the Servers resource and
+// returns their status, along with the error for the last allocation that
+// failed. The allocations that the status already reports keep their capacity,
+// so they're charged to the ledger before the new allocations are checked
+// against what's left.
+func allocateServers(servers *dwsv1alpha2.Servers, args map[string]string, ledger *capacityLedger, severity dwsv1alpha2.ResourceErrorSeverity) ([]dwsv1alpha2.ServersStatusAllocationSet, *dwsv1alpha2.ResourceErrorInfo) {
+	overrun := ledger.hold(servers)
+
+	var resErr *dwsv1alpha2.ResourceErrorInfo
+	allocationSets := []dwsv1alpha2.ServersStatusAllocationSet{}
+
+	for _, allocationSet := range servers.Spec.AllocationSets {
+		storage := map[string]dwsv1alpha2.ServersStatusStorage{}
+
+		for _, allocation := range allocationSet.Storage {
+			if failAllocation(args, allocationSet.Label, allocation.Name) {
+				resErr = allocationError(args, allocationSet.Label, allocation.Name)
+				continue
+			}
+
+			if overrun[allocation.Name] || !isAllocated(&servers.Status, allocationSet.Label, allocation.Name, allocationSet.AllocationSize) {
+				size := allocationSet.AllocationSize * int64(allocation.AllocationCount)
+				if allocErr := ledger.allocate(allocation.Name, size, severity); allocErr != nil {
+					resErr = allocErr
+					continue
+				}
+			}
+
+			storage[allocation.Name] = dwsv1alpha2.ServersStatusStorage{AllocationSize: allocationSet.AllocationSize}
+		}
+
+		allocationSets = append(allocationSets, dwsv1alpha2.ServersStatusAllocationSet{
+			Label:   allocationSet.Label,
+			Storage: storage,
+		})
+	}
+
+	return allocationSets, resErr
+}
+
+// isAllocated returns true if the status already reports the allocation of an
+// allocation set on a storage
+func isAllocated(status *dwsv1alpha2.ServersStatus, label string, storage string, size int64) bool {
+	for _, allocationSet := range status.AllocationSets {
+		if allocationSet.Label != label {
+			continue
+		}
+
+		if allocation, found := allocationSet.Storage[storage]; found && allocation.AllocationSize == size {
+			return true
+		}
+	}
+
+	return false
+}
+
+// directiveArgs returns the arguments of the directive that the Servers
+// resource was created for, found through its owner. That's the
+// DirectiveBreakdown for job storage, or the PersistentStorageInstance for
+// persistent storage.
+func (r *ServersReconciler) directiveArgs(ctx context.Context, servers *dwsv1alpha2.Servers) (map[string]string, error) {
+	labels := servers.GetLabels()
+	owner := types.NamespacedName{Name: labels[dwsv1alpha2.OwnerNameLabel], Namespace: labels[dwsv1alpha2.OwnerNamespaceLabel]}
+
+	if labels[dwsv1alpha2.OwnerKindLabel] == reflect.TypeOf(dwsv1alpha2.PersistentStorageInstance{}).Name() {
+		psi := &dwsv1alpha2.PersistentStorageInstance{}
+		if err := r.Get(ctx, owner, psi); err != nil {
+			return nil, err
+		}
+
+		return dwdparse.BuildArgsMap(psi.Spec.DWDirective)
+	}
+
+	breakdown := &dwsv1alpha2.DirectiveBreakdown{}
+	if err := r.Get(ctx, owner, breakdown); err != nil {
+		return nil, err
+	}
+
+	return dwdparse.BuildArgsMap(breakdown.Spec.Directive)
+}
+
+// validatePlacement checks the allocations that the WLM placed in the Servers
+// resource against the constraints of the DirectiveBreakdown whose storage
+// constraints refer to it. The chosen storage must have the labels that the
+// constraints require, and storage under an exclusive colocation key can't be
+// shared with the allocations of other Servers resources. Returns the error
+// for a broken constraint, or nil if there is no such DirectiveBreakdown.
+func (r *ServersReconciler) validatePlacement(ctx context.Context, servers *dwsv1alpha2.Servers) (*dwsv1alpha2.ResourceErrorInfo, error) {
+	breakdown, err := breakdownForServers(ctx, r.Client, servers)
+	if err != nil || breakdown == nil {
+		return nil, err
+	}
+
+	if resErr := validateAllocations(&breakdown.Status, &servers.Spec); resErr != nil {
+		return resErr, nil
+	}
+
+	labels, err := storageLabels(ctx, r.Client, &servers.Spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if resErr := validateStorageLabels(&breakdown.Status, &servers.Spec, labels); resErr != nil {
+		return resErr, nil
+	}
+
+	taken, err := exclusiveStorageTaken(ctx, r.Client, servers)
+	if err != nil {
+		return nil, err
+	}
+
+	return validateExclusiveColocation(&breakdown.Status, &servers.Spec, taken), nil
+}
+
+// failAllocation returns true if the directive asked for the allocation to
+// fail. The fail_allocation argument names an allocation set and the
+// fail_storage argument names a storage resource. Given both, only the
+// allocation of that set on that storage fails.
+func failAllocation(args map[string]string, label string, storage string) bool {
+	failLabel, labelFound := args["fail_allocation"]
+	failStorage, storageFound := args["fail_storage"]
+
+	if !labelFound && !storageFound {
+		return false
+	}
+
+	return (!labelFound || failLabel == label) && (!storageFound || failStorage == storage)
+}
+
+// allocationError builds the error for a failed allocation from the message
+// and severity arguments of the directive
+func allocationError(args map[string]string, label string, storage string) *dwsv1alpha2.ResourceErrorInfo {
+	resErr := dwsv1alpha2.NewResourceError("allocation '%s' failed on storage '%s'", label, storage)
+	if message, found := args["message"]; found {
+		resErr = resErr.WithUserMessage("%s", strings.ReplaceAll(message, "_", " "))
+	}
+
+	severity, err := ParseSeverity(args["severity"])
+	if err != nil {
+		return dwsv1alpha2.NewResourceError("").WithError(err).
+			WithUserMessage("invalid 'severity' argument '%s'", args["severity"]).WithUser().WithFatal()
+	}
+
+	resErr.Severity = severity
+	return resErr
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ServersReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&dwsv1alpha2.Servers{}, builder.WithPredicates(predicate.NewPredicateFuncs(isDriverResource))).
+		Complete(r)
+}
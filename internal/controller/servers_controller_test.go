@@ -0,0 +1,232 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Servers Controller Test", func() {
+
+	DescribeTable("Chooses the allocations to fail",
+		func(args map[string]string, label string, storage string, expected bool) {
+			Expect(failAllocation(args, label, storage)).To(Equal(expected))
+		},
+		Entry("with no failure requested", map[string]string{}, "xfs", "rabbit-0", false),
+		Entry("with a matching allocation set", map[string]string{"fail_allocation": "ost"}, "ost", "rabbit-0", true),
+		Entry("with another allocation set", map[string]string{"fail_allocation": "ost"}, "mdt", "rabbit-0", false),
+		Entry("with a matching storage", map[string]string{"fail_storage": "rabbit-1"}, "mdt", "rabbit-1", true),
+		Entry("with another storage", map[string]string{"fail_storage": "rabbit-1"}, "mdt", "rabbit-0", false),
+		Entry("with a matching allocation set on another storage",
+			map[string]string{"fail_allocation": "ost", "fail_storage": "rabbit-1"}, "ost", "rabbit-0", false),
+		Entry("with a matching allocation set and storage",
+			map[string]string{"fail_allocation": "ost", "fail_storage": "rabbit-1"}, "ost", "rabbit-1", true),
+	)
+
+	DescribeTable("Builds allocation errors",
+		func(severity string, expected dwsv1alpha2.ResourceErrorSeverity) {
+			resErr := allocationError(map[string]string{"severity": severity, "message": "out_of_space"}, "ost", "rabbit-1")
+			Expect(resErr.Severity).To(Equal(expected))
+			Expect(resErr.UserMessage).To(Equal("out of space"))
+		},
+		Entry("with the default severity", "", dwsv1alpha2.SeverityMinor),
+		Entry("with a Major severity", "Major", dwsv1alpha2.SeverityMajor),
+		Entry("with a Fatal severity", "fatal", dwsv1alpha2.SeverityFatal),
+	)
+
+	It("Fails on unknown severities", func() {
+		resErr := allocationError(map[string]string{"severity": "bad"}, "ost", "rabbit-1")
+		Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+		Expect(resErr.Type).To(Equal(dwsv1alpha2.TypeUser))
+	})
+
+	Context("Allocating against the storage capacity", func() {
+
+		const gib = int64(1024 * 1024 * 1024)
+
+		var servers *dwsv1alpha2.Servers
+
+		BeforeEach(func() {
+			servers = &dwsv1alpha2.Servers{
+				Spec: dwsv1alpha2.ServersSpec{
+					AllocationSets: []dwsv1alpha2.ServersSpecAllocationSet{
+						{Label: "ost", AllocationSize: 2 * gib, Storage: []dwsv1alpha2.ServersSpecStorage{{Name: "rabbit-0", AllocationCount: 1}}},
+						{Label: "mdt", AllocationSize: 2 * gib, Storage: []dwsv1alpha2.ServersSpecStorage{{Name: "rabbit-0", AllocationCount: 1}}},
+					},
+				},
+			}
+		})
+
+		// allocate runs the allocations against a ledger of the given capacity,
+		// the way each reconcile loads a fresh ledger without the Servers
+		// resource's own allocations, and records the result in the status
+		allocate := func(capacity int64) *dwsv1alpha2.ResourceErrorInfo {
+			ledger := &capacityLedger{capacity: map[string]int64{"rabbit-0": capacity}, allocated: map[string]int64{}}
+
+			var resErr *dwsv1alpha2.ResourceErrorInfo
+			servers.Status.AllocationSets, resErr = allocateServers(servers, map[string]string{}, ledger, dwsv1alpha2.SeverityMajor)
+			return resErr
+		}
+
+		It("Keeps failing allocation sets that together exceed the capacity", func() {
+			for i := 0; i < 3; i++ {
+				resErr := allocate(3 * gib)
+				Expect(resErr).ToNot(BeNil())
+				Expect(resErr.Severity).To(Equal(dwsv1alpha2.SeverityMajor))
+				Expect(resErr.Error()).To(ContainSubstring("requested 2147483648 bytes, 1073741824 bytes free"))
+
+				Expect(servers.Status.AllocationSets).To(Equal([]dwsv1alpha2.ServersStatusAllocationSet{
+					{Label: "ost", Storage: map[string]dwsv1alpha2.ServersStatusStorage{"rabbit-0": {AllocationSize: 2 * gib}}},
+					{Label: "mdt", Storage: map[string]dwsv1alpha2.ServersStatusStorage{}},
+				}))
+			}
+		})
+
+		It("Makes allocation sets that together fit the capacity", func() {
+			Expect(allocate(4 * gib)).To(BeNil())
+			Expect(allocate(4 * gib)).To(BeNil())
+			Expect(servers.Status.AllocationSets[1].Storage).To(HaveKey("rabbit-0"))
+		})
+
+		It("Fails an allocation whose count grows past the capacity", func() {
+			Expect(allocate(5 * gib)).To(BeNil())
+
+			servers.Spec.AllocationSets[1].Storage[0].AllocationCount = 2
+			resErr := allocate(5 * gib)
+			Expect(resErr).ToNot(BeNil())
+			Expect(resErr.Error()).To(ContainSubstring("requested 4294967296 bytes, 3221225472 bytes free"))
+			Expect(servers.Status.AllocationSets[0].Storage).To(HaveKey("rabbit-0"))
+			Expect(servers.Status.AllocationSets[1].Storage).To(BeEmpty())
+
+			// Once dropped from the status, the allocation is checked as new
+			Expect(allocate(5 * gib)).ToNot(BeNil())
+			Expect(servers.Status.AllocationSets[0].Storage).To(HaveKey("rabbit-0"))
+		})
+	})
+})
+
+var _ = Describe("Servers Reconciler Test", func() {
+
+	var (
+		breakdown *dwsv1alpha2.DirectiveBreakdown
+		servers   *dwsv1alpha2.Servers
+		storage   string
+	)
+
+	BeforeEach(func() {
+		id := uuid.NewString()[0:8]
+		storage = "rabbit-" + id
+
+		breakdown = &dwsv1alpha2.DirectiveBreakdown{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "servers-" + id,
+				Namespace: corev1.NamespaceDefault,
+				Labels:    map[string]string{driverLabel: DRIVERID},
+			},
+		}
+
+		servers = &dwsv1alpha2.Servers{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "servers-" + id,
+				Namespace: corev1.NamespaceDefault,
+				Labels: map[string]string{
+					driverLabel:                     DRIVERID,
+					dwsv1alpha2.OwnerKindLabel:      reflect.TypeOf(dwsv1alpha2.DirectiveBreakdown{}).Name(),
+					dwsv1alpha2.OwnerNameLabel:      breakdown.Name,
+					dwsv1alpha2.OwnerNamespaceLabel: breakdown.Namespace,
+				},
+			},
+			Spec: dwsv1alpha2.ServersSpec{
+				AllocationSets: []dwsv1alpha2.ServersSpecAllocationSet{{
+					Label:          "xfs",
+					AllocationSize: 1024 * 1024 * 1024,
+					Storage:        []dwsv1alpha2.ServersSpecStorage{{Name: storage, AllocationCount: 1}},
+				}},
+			},
+		}
+	})
+
+	// create makes the DirectiveBreakdown for the directive and the Servers
+	// resource placed by the WLM
+	create := func(directive string) {
+		breakdown.Spec.Directive = directive
+		Expect(k8sClient.Create(context.TODO(), breakdown)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(k8sClient.Delete(context.TODO(), breakdown)).To(Succeed())
+		})
+
+		Expect(k8sClient.Create(context.TODO(), servers)).To(Succeed())
+		DeferCleanup(func() {
+			Expect(k8sClient.Delete(context.TODO(), servers)).To(Succeed())
+		})
+	}
+
+	getStatus := func() dwsv1alpha2.ServersStatus {
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(servers), servers)).To(Succeed())
+		return servers.Status
+	}
+
+	It("Reports the allocations placed by the WLM", func() {
+		create("#DW jobdw type=xfs capacity=1GiB name=servers")
+
+		Eventually(getStatus).Should(HaveField("Ready", BeTrue()))
+		Expect(servers.Status.Error).To(BeNil())
+		Expect(servers.Status.AllocationSets).To(Equal([]dwsv1alpha2.ServersStatusAllocationSet{{
+			Label:   "xfs",
+			Storage: map[string]dwsv1alpha2.ServersStatusStorage{storage: {AllocationSize: 1024 * 1024 * 1024}},
+		}}))
+	})
+
+	It("Fails the allocation for good when the failure is fatal", func() {
+		create("#DW jobdw type=xfs capacity=1GiB name=servers fail_allocation=xfs severity=Fatal message=no_space")
+
+		Eventually(getStatus).Should(HaveField("Error", Not(BeNil())))
+		Expect(servers.Status.Ready).To(BeFalse())
+		Expect(servers.Status.Error.Severity).To(Equal(dwsv1alpha2.SeverityFatal))
+		Expect(servers.Status.Error.UserMessage).To(Equal("no space"))
+		Expect(servers.Status.AllocationSets).To(HaveLen(1))
+		Expect(servers.Status.AllocationSets[0].Storage).To(BeEmpty())
+	})
+
+	It("Retries the allocation when the failure isn't fatal", func() {
+		create("#DW jobdw type=xfs capacity=1GiB name=servers fail_allocation=xfs severity=Major")
+
+		Eventually(getStatus).Should(HaveField("Error", Not(BeNil())))
+		Expect(servers.Status.Ready).To(BeFalse())
+		Expect(servers.Status.Error.Severity).To(Equal(dwsv1alpha2.SeverityMajor))
+
+		// The allocation is made on a retry once the directive stops asking
+		// for it to fail
+		Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(breakdown), breakdown)).To(Succeed())
+		breakdown.Spec.Directive = "#DW jobdw type=xfs capacity=1GiB name=servers"
+		Expect(k8sClient.Update(context.TODO(), breakdown)).To(Succeed())
+
+		Eventually(getStatus).WithTimeout(2 * resourceErrorRetryInterval).WithPolling(time.Second).Should(HaveField("Ready", BeTrue()))
+		Expect(servers.Status.Error).To(BeNil())
+	})
+})
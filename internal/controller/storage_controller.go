@@ -0,0 +1,371 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"github.com/DataWorkflowServices/dws/utils/updater"
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// Annotations on a Storage resource that change the status the simulator
+// reports for it
+const (
+	// storageStatusAnnotation overrides the status of the storage node, such
+	// as "Offline"
+	storageStatusAnnotation = testerDomain + "storage-status"
+
+	// deviceStatusAnnotation sets the status of devices by slot, such as
+	// "0=Failed,3=Degraded"
+	deviceStatusAnnotation = testerDomain + "device-status"
+
+	// deviceWearAnnotation sets the wear level of devices by slot, such as
+	// "1=95"
+	deviceWearAnnotation = testerDomain + "device-wear"
+
+	// computeStatusAnnotation sets the status of the compute nodes with access
+	// to the storage, such as "node01=Offline"
+	computeStatusAnnotation = testerDomain + "compute-status"
+)
+
+// deviceModel is the model reported for every simulated device
+const deviceModel = "Tester NVMe SSD"
+
+// StorageReconciler simulates an inventory of storage nodes. It creates a
+// Storage resource for each node and keeps its status current. The status of
+// the node, its devices, and the compute nodes attached to it can be changed
+// through annotations on the Storage resource.
+type StorageReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// Nodes are the names of the simulated storage nodes
+	Nodes []string
+
+	// Devices is the number of devices in each storage node
+	Devices int
+
+	// DeviceCapacity is the capacity of each device in bytes
+	DeviceCapacity int64
+}
+
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=storages,verbs=get;list;watch;create;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=storages/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=systemconfigurations,verbs=get;list;watch
+
+// Reconcile rebuilds the status of a simulated Storage resource from the
+// simulator's configuration, the SystemConfiguration, and the annotations on
+// the resource.
+func (r *StorageReconciler) Reconcile(ctx context.Context, req ctrl.Request) (res ctrl.Result, err error) {
+	log := r.Log.WithValues("Storage", req.NamespacedName)
+
+	storage := &dwsv1alpha2.Storage{}
+	if err := r.Get(ctx, req.NamespacedName, storage); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if !storage.GetDeletionTimestamp().IsZero() {
+		return ctrl.Result{}, nil
+	}
+
+	statusUpdater := updater.NewStatusUpdater[*dwsv1alpha2.StorageStatus](storage)
+	defer func() { err = statusUpdater.CloseWithStatusUpdate(ctx, r.Client.Status(), err) }()
+
+	computes, err := r.attachedComputes(ctx, storage.Name)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	status, err := storageStatus(storage, r.Devices, r.DeviceCapacity, computes)
+	if err != nil {
+		// A bad command can't be fixed by retrying, so report it on the resource
+		log.Info("Invalid storage command", "error", err.Error())
+		storage.Status.Message = err.Error()
+		return ctrl.Result{}, nil
+	}
+
+	if storage.Status.Status != status.Status {
+		log.Info("Storage status changed", "from", storage.Status.Status, "to", status.Status)
+	}
+	storage.Status = *status
+
+	return ctrl.Result{}, nil
+}
+
+// attachedComputes returns the compute nodes that the SystemConfiguration
+// lists as having access to the storage node
+func (r *StorageReconciler) attachedComputes(ctx context.Context, node string) ([]string, error) {
+	systemConfiguration := &dwsv1alpha2.SystemConfiguration{}
+	if err := r.Get(ctx, systemConfigurationName, systemConfiguration); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	computes := []string{}
+	for _, storageNode := range systemConfiguration.Spec.StorageNodes {
+		if storageNode.Name != node {
+			continue
+		}
+
+		for _, compute := range storageNode.ComputesAccess {
+			computes = append(computes, compute.Name)
+		}
+	}
+
+	return computes, nil
+}
+
+// storageStatus builds the status of a simulated storage node with the given
+// number of devices and attached compute nodes. The devices are named after
+// the node so that they're the same every time. The annotations on the
+// Storage resource change the status of the node, its devices, and its
+// compute nodes.
+func storageStatus(storage *dwsv1alpha2.Storage, devices int, deviceCapacity int64, computes []string) (*dwsv1alpha2.StorageStatus, error) {
+	annotations := storage.GetAnnotations()
+
+	deviceStatuses, err := parseStatusCommand(annotations[deviceStatusAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", deviceStatusAnnotation, err)
+	}
+
+	computeStatuses, err := parseStatusCommand(annotations[computeStatusAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", computeStatusAnnotation, err)
+	}
+
+	wearLevels, err := parseCommand(annotations[deviceWearAnnotation])
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %w", deviceWearAnnotation, err)
+	}
+
+	status := &dwsv1alpha2.StorageStatus{
+		Type: dwsv1alpha2.NVMe,
+		Access: dwsv1alpha2.StorageAccess{
+			Protocol: dwsv1alpha2.PCIe,
+			Servers:  []dwsv1alpha2.Node{{Name: storage.Name, Status: dwsv1alpha2.ReadyStatus}},
+			Computes: []dwsv1alpha2.Node{},
+		},
+		Status: dwsv1alpha2.ReadyStatus,
+	}
+
+	degraded := false
+	for slot := 0; slot < devices; slot++ {
+		serial := deviceSerial(storage.Name, slot)
+		wearLevel := int64(fnvHash(serial) % 20)
+
+		if value, found := wearLevels[strconv.Itoa(slot)]; found {
+			wearLevel, err = strconv.ParseInt(value, 10, 64)
+			if err != nil || wearLevel < 0 || wearLevel > 100 {
+				return nil, fmt.Errorf("invalid wear level '%s' for slot %d", value, slot)
+			}
+		}
+
+		deviceStatus := dwsv1alpha2.ReadyStatus
+		if value, found := deviceStatuses[strconv.Itoa(slot)]; found {
+			deviceStatus = value
+			degraded = degraded || deviceStatus != dwsv1alpha2.ReadyStatus
+		}
+
+		status.Devices = append(status.Devices, dwsv1alpha2.StorageDevice{
+			Model:           deviceModel,
+			SerialNumber:    serial,
+			FirmwareVersion: "1.0.0",
+			Slot:            strconv.Itoa(slot),
+			Capacity:        deviceCapacity,
+			WearLevel:       &wearLevel,
+			Status:          deviceStatus,
+		})
+
+		if deviceStatus == dwsv1alpha2.ReadyStatus || deviceStatus == dwsv1alpha2.DegradedStatus {
+			status.Capacity += deviceCapacity
+		}
+	}
+
+	for _, compute := range computes {
+		computeStatus := dwsv1alpha2.ReadyStatus
+		if value, found := computeStatuses[compute]; found {
+			computeStatus = value
+		}
+
+		status.Access.Computes = append(status.Access.Computes, dwsv1alpha2.Node{Name: compute, Status: computeStatus})
+	}
+
+	if degraded {
+		status.Status = dwsv1alpha2.DegradedStatus
+	}
+
+	if value, found := annotations[storageStatusAnnotation]; found {
+		nodeStatus, err := parseResourceStatus(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s annotation: %w", storageStatusAnnotation, err)
+		}
+
+		status.Status = nodeStatus
+		status.Access.Servers[0].Status = nodeStatus
+	}
+
+	if storage.Spec.State == dwsv1alpha2.DisabledState {
+		status.Status = dwsv1alpha2.DisabledStatus
+	}
+
+	return status, nil
+}
+
+// deviceSerial returns the serial number of the device in a slot of a node
+func deviceSerial(node string, slot int) string {
+	return fmt.Sprintf("TST%08X", fnvHash(fmt.Sprintf("%s/%d", node, slot)))
+}
+
+// fnvHash returns the 32 bit FNV-1a hash of a string
+func fnvHash(value string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(value))
+
+	return hash.Sum32()
+}
+
+// parseCommand parses a command of the form "key=value,key=value"
+func parseCommand(command string) (map[string]string, error) {
+	values := map[string]string{}
+
+	for _, element := range strings.Split(command, ",") {
+		if element = strings.TrimSpace(element); element == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(element, "=")
+		if !found || key == "" || value == "" {
+			return nil, fmt.Errorf("expected 'key=value' but found '%s'", element)
+		}
+
+		values[key] = value
+	}
+
+	return values, nil
+}
+
+// parseStatusCommand parses a command of the form "key=status,key=status"
+func parseStatusCommand(command string) (map[string]dwsv1alpha2.ResourceStatus, error) {
+	values, err := parseCommand(command)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := map[string]dwsv1alpha2.ResourceStatus{}
+	for key, value := range values {
+		status, err := parseResourceStatus(value)
+		if err != nil {
+			return nil, err
+		}
+
+		statuses[key] = status
+	}
+
+	return statuses, nil
+}
+
+// parseResourceStatus parses the status of a DWS resource
+func parseResourceStatus(value string) (dwsv1alpha2.ResourceStatus, error) {
+	for _, status := range []dwsv1alpha2.ResourceStatus{
+		dwsv1alpha2.StartingStatus,
+		dwsv1alpha2.ReadyStatus,
+		dwsv1alpha2.DisabledStatus,
+		dwsv1alpha2.NotPresentStatus,
+		dwsv1alpha2.OfflineStatus,
+		dwsv1alpha2.FailedStatus,
+		dwsv1alpha2.DegradedStatus,
+		dwsv1alpha2.UnknownStatus,
+	} {
+		if strings.EqualFold(value, string(status)) {
+			return status, nil
+		}
+	}
+
+	return "", fmt.Errorf("unknown status '%s'", value)
+}
+
+// createStorage creates the Storage resources of the simulated storage nodes
+// that don't already exist
+func (r *StorageReconciler) createStorage(ctx context.Context) error {
+	for _, node := range r.Nodes {
+		storage := &dwsv1alpha2.Storage{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      node,
+				Namespace: corev1.NamespaceDefault,
+				Labels: map[string]string{
+					dwsv1alpha2.StorageTypeLabel: DRIVERID,
+					driverLabel:                  DRIVERID,
+				},
+			},
+			Spec: dwsv1alpha2.StorageSpec{
+				State: dwsv1alpha2.EnabledState,
+			},
+		}
+
+		if err := r.Create(ctx, storage); err != nil {
+			if apierrors.IsAlreadyExists(err) {
+				continue
+			}
+
+			return err
+		}
+
+		r.Log.Info("Created Storage", "name", node)
+	}
+
+	return nil
+}
+
+// storageMapFunc maps a change to the SystemConfiguration to all of the
+// simulated Storage resources
+func (r *StorageReconciler) storageMapFunc(ctx context.Context, object client.Object) []reconcile.Request {
+	requests := []reconcile.Request{}
+	for _, node := range r.Nodes {
+		requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKey{Name: node, Namespace: corev1.NamespaceDefault}})
+	}
+
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *StorageReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	if err := mgr.Add(manager.RunnableFunc(r.createStorage)); err != nil {
+		return err
+	}
+
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&dwsv1alpha2.Storage{}, builder.WithPredicates(predicate.NewPredicateFuncs(isDriverResource))).
+		Watches(&dwsv1alpha2.SystemConfiguration{}, handler.EnqueueRequestsFromMapFunc(r.storageMapFunc)).
+		Complete(r)
+}
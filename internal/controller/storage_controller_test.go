@@ -0,0 +1,108 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Storage Controller Test", func() {
+
+	const deviceCapacity = 1000
+
+	var storage *dwsv1alpha2.Storage
+
+	BeforeEach(func() {
+		storage = &dwsv1alpha2.Storage{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "rabbit-0",
+				Namespace:   corev1.NamespaceDefault,
+				Annotations: map[string]string{},
+			},
+			Spec: dwsv1alpha2.StorageSpec{State: dwsv1alpha2.EnabledState},
+		}
+	})
+
+	It("Reports a healthy storage node", func() {
+		status, err := storageStatus(storage, 4, deviceCapacity, []string{"node1", "node2"})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(status.Status).To(Equal(dwsv1alpha2.ReadyStatus))
+		Expect(status.Capacity).To(Equal(int64(4 * deviceCapacity)))
+		Expect(status.Devices).To(HaveLen(4))
+		Expect(status.Access.Servers).To(Equal([]dwsv1alpha2.Node{{Name: "rabbit-0", Status: dwsv1alpha2.ReadyStatus}}))
+		Expect(status.Access.Computes).To(HaveLen(2))
+
+		// Devices are the same every time
+		again, err := storageStatus(storage, 4, deviceCapacity, []string{"node1", "node2"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(again).To(Equal(status))
+	})
+
+	It("Degrades a storage node with failed devices", func() {
+		storage.Annotations[deviceStatusAnnotation] = "1=Failed"
+		storage.Annotations[deviceWearAnnotation] = "2=95"
+
+		status, err := storageStatus(storage, 4, deviceCapacity, []string{})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(status.Status).To(Equal(dwsv1alpha2.DegradedStatus))
+		Expect(status.Capacity).To(Equal(int64(3 * deviceCapacity)))
+		Expect(status.Devices[1].Status).To(Equal(dwsv1alpha2.FailedStatus))
+		Expect(*status.Devices[2].WearLevel).To(Equal(int64(95)))
+	})
+
+	It("Changes the status of the node and its computes", func() {
+		storage.Annotations[storageStatusAnnotation] = "offline"
+		storage.Annotations[computeStatusAnnotation] = "node2=Offline"
+
+		status, err := storageStatus(storage, 1, deviceCapacity, []string{"node1", "node2"})
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(status.Status).To(Equal(dwsv1alpha2.OfflineStatus))
+		Expect(status.Access.Servers[0].Status).To(Equal(dwsv1alpha2.OfflineStatus))
+		Expect(status.Access.Computes).To(Equal([]dwsv1alpha2.Node{
+			{Name: "node1", Status: dwsv1alpha2.ReadyStatus},
+			{Name: "node2", Status: dwsv1alpha2.OfflineStatus},
+		}))
+	})
+
+	It("Reports a disabled storage node", func() {
+		storage.Spec.State = dwsv1alpha2.DisabledState
+
+		status, err := storageStatus(storage, 1, deviceCapacity, []string{})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(status.Status).To(Equal(dwsv1alpha2.DisabledStatus))
+	})
+
+	DescribeTable("Rejects invalid commands",
+		func(annotation string, value string) {
+			storage.Annotations[annotation] = value
+			_, err := storageStatus(storage, 4, deviceCapacity, []string{})
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("with an unknown status", storageStatusAnnotation, "Broken"),
+		Entry("with a missing device status", deviceStatusAnnotation, "1"),
+		Entry("with an unknown device status", deviceStatusAnnotation, "1=Broken"),
+		Entry("with a wear level over 100", deviceWearAnnotation, "0=101"),
+	)
+})
@@ -0,0 +1,303 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	dwdparse "github.com/DataWorkflowServices/dws/utils/dwdparse"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// storageFailureSettleInterval is how long after failing a storage node to
+// check the driver status entries that depend on it, giving the simulator time
+// to report the failure
+const storageFailureSettleInterval = time.Second
+
+// checksStorageHealth returns true for the states in which the driver status
+// entries of a workflow fail when its storage is on an unhealthy storage node.
+// Entries in Proposal have no storage yet, and Teardown has to be able to
+// clean up after a failure.
+func checksStorageHealth(state dwsv1alpha2.WorkflowState) bool {
+	switch state {
+	case dwsv1alpha2.StateSetup, dwsv1alpha2.StateDataIn, dwsv1alpha2.StatePreRun, dwsv1alpha2.StatePostRun, dwsv1alpha2.StateDataOut:
+		return true
+	}
+
+	return false
+}
+
+// storageHealth returns the severity of the errors reported by the resources
+// that depend on a storage node, or an empty severity if the node is healthy.
+// A degraded node, such as one with a failed device, is a Major problem and a
+// node that is down is a Fatal one.
+func storageHealth(storage *dwsv1alpha2.Storage) dwsv1alpha2.ResourceErrorSeverity {
+	switch storage.Status.Status {
+	case dwsv1alpha2.ReadyStatus, "":
+		return ""
+	case dwsv1alpha2.DegradedStatus:
+		return dwsv1alpha2.SeverityMajor
+	}
+
+	return dwsv1alpha2.SeverityFatal
+}
+
+// workflowStorageNodes returns the storage nodes that hold the allocations of
+// a workflow's storage, including the persistent storage that it creates or
+// uses
+func workflowStorageNodes(ctx context.Context, c client.Client, workflow *dwsv1alpha2.Workflow) ([]string, error) {
+	serversList := &dwsv1alpha2.ServersList{}
+	matchingLabels := dwsv1alpha2.MatchingWorkflow(workflow)
+	matchingLabels[driverLabel] = DRIVERID
+	if err := c.List(ctx, serversList, client.InNamespace(workflow.Namespace), matchingLabels); err != nil {
+		return nil, err
+	}
+
+	for _, directive := range workflow.Spec.DWDirectives {
+		args, err := dwdparse.BuildArgsMap(directive)
+		if err != nil || (args["command"] != "persistentdw" && args["command"] != "create_persistent") {
+			continue
+		}
+
+		servers := &dwsv1alpha2.Servers{}
+		if err := c.Get(ctx, types.NamespacedName{Name: args["name"], Namespace: workflow.Namespace}, servers); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		serversList.Items = append(serversList.Items, *servers)
+	}
+
+	found := map[string]bool{}
+	nodes := []string{}
+	for i := range serversList.Items {
+		for _, node := range serversStorageNodes(&serversList.Items[i]) {
+			if !found[node] {
+				found[node] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+// storageFailure returns the error for the unhealthy storage nodes that hold
+// the workflow's storage, or nil if they're all healthy. The error has the
+// severity of the least healthy node. Storage nodes that aren't simulated by
+// the driver are taken to be healthy.
+func storageFailure(ctx context.Context, c client.Client, workflow *dwsv1alpha2.Workflow) (*dwsv1alpha2.ResourceErrorInfo, error) {
+	nodes, err := workflowStorageNodes(ctx, c, workflow)
+	if err != nil {
+		return nil, err
+	}
+
+	problems := []string{}
+	severity := dwsv1alpha2.ResourceErrorSeverity("")
+	for _, node := range nodes {
+		storage := &dwsv1alpha2.Storage{}
+		if err := c.Get(ctx, types.NamespacedName{Name: node, Namespace: corev1.NamespaceDefault}, storage); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		nodeSeverity := storageHealth(storage)
+		if nodeSeverity == "" {
+			continue
+		}
+
+		problems = append(problems, fmt.Sprintf("storage node '%s' is %s", node, storage.Status.Status))
+		if severity != dwsv1alpha2.SeverityFatal {
+			severity = nodeSeverity
+		}
+	}
+
+	if len(problems) == 0 {
+		return nil, nil
+	}
+
+	message := strings.Join(problems, ", ")
+	resErr := dwsv1alpha2.NewResourceError("%s", message).WithUserMessage("%s", message)
+	resErr.Severity = severity
+
+	return resErr, nil
+}
+
+// failStorageAction marks the simulated Storage resource named by the node
+// argument unhealthy once the time given by the at argument has passed since
+// the start of the state. The whole node goes Offline, or only the device in
+// the slot given by the device argument Fails. Returns the time until the
+// workflow should be reconciled again, either for the failure to be due or for
+// the entries that depend on the storage node to see it.
+func (r *WorkflowReconciler) failStorageAction(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) (time.Duration, error) {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow), "index", driverStatus.DWDIndex)
+
+	node := args["node"]
+	if node == "" {
+		setDriverError(driverStatus, dwsv1alpha2.NewResourceError("missing node").
+			WithUserMessage("missing 'node' argument").WithUser().WithFatal())
+		return 0, nil
+	}
+
+	at := time.Duration(0)
+	if value, found := args["at"]; found {
+		var err error
+		if at, err = time.ParseDuration(value); err != nil || at < 0 {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("invalid at '%s'", value).
+				WithUserMessage("invalid 'at' argument '%s'", value).WithUser().WithFatal())
+			return 0, nil
+		}
+	}
+
+	device := -1
+	if value, found := args["device"]; found {
+		var err error
+		if device, err = strconv.Atoi(value); err != nil || device < 0 {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("invalid device '%s'", value).
+				WithUserMessage("invalid 'device' argument '%s'", value).WithUser().WithFatal())
+			return 0, nil
+		}
+	}
+
+	start := time.Now()
+	if workflow.Status.DesiredStateChange != nil {
+		start = workflow.Status.DesiredStateChange.Time
+	}
+
+	if remaining := at - time.Since(start); remaining > 0 {
+		driverStatus.Status = dwsv1alpha2.StatusRunning
+		driverStatus.Message = fmt.Sprintf("Failing storage node '%s' at %s", node, start.Add(at).UTC().Format(time.RFC3339))
+		driverStatus.Error = ""
+		return remaining, nil
+	}
+
+	storage := &dwsv1alpha2.Storage{}
+	if err := r.Get(ctx, types.NamespacedName{Name: node, Namespace: corev1.NamespaceDefault}, storage); err != nil {
+		if apierrors.IsNotFound(err) {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("").WithError(err).
+				WithUserMessage("storage node '%s' is not simulated", node).WithUser().WithFatal())
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	annotations := storage.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+
+	if device < 0 {
+		annotations[storageStatusAnnotation] = string(dwsv1alpha2.OfflineStatus)
+	} else {
+		annotations[deviceStatusAnnotation] = setCommandValue(annotations[deviceStatusAnnotation],
+			strconv.Itoa(device), string(dwsv1alpha2.FailedStatus))
+	}
+	storage.SetAnnotations(annotations)
+
+	if err := r.Update(ctx, storage); err != nil {
+		return 0, err
+	}
+
+	log.Info("Failed storage", "node", node, "device", device)
+	completeDriverStatus(driverStatus)
+	if device < 0 {
+		driverStatus.Message = fmt.Sprintf("Failed storage node '%s'", node)
+	} else {
+		driverStatus.Message = fmt.Sprintf("Failed device %d of storage node '%s'", device, node)
+	}
+
+	return storageFailureSettleInterval, nil
+}
+
+// storageMapFunc maps a change to a simulated storage node to the workflows
+// with storage on it, so that their driver status entries see a failure of the
+// node as soon as it's reported. The Servers resource of persistent storage
+// belongs to its PersistentStorageInstance, and the workflows using it are the
+// consumers of the instance.
+func (r *WorkflowReconciler) storageMapFunc(ctx context.Context, object client.Object) []reconcile.Request {
+	serversList := &dwsv1alpha2.ServersList{}
+	if err := r.List(ctx, serversList, client.MatchingLabels{driverLabel: DRIVERID}); err != nil {
+		r.Log.Error(err, "Could not list Servers")
+		return []reconcile.Request{}
+	}
+
+	requests := []reconcile.Request{}
+	for i := range serversList.Items {
+		servers := &serversList.Items[i]
+		if !containsString(serversStorageNodes(servers), object.GetName()) {
+			continue
+		}
+
+		requests = append(requests, workflowLabelMapFunc(ctx, servers)...)
+
+		name, found := servers.GetLabels()[dwsv1alpha2.PersistentStorageNameLabel]
+		if !found {
+			continue
+		}
+
+		psi := &dwsv1alpha2.PersistentStorageInstance{}
+		if err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: servers.GetLabels()[dwsv1alpha2.PersistentStorageNamespaceLabel]}, psi); err != nil {
+			if !apierrors.IsNotFound(err) {
+				r.Log.Error(err, "Could not get PersistentStorageInstance", "name", name)
+			}
+			continue
+		}
+
+		requests = append(requests, workflowLabelMapFunc(ctx, psi)...)
+		for _, consumer := range psi.Spec.ConsumerReferences {
+			if consumer.Kind == reflect.TypeOf(dwsv1alpha2.Workflow{}).Name() {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: consumer.Name, Namespace: consumer.Namespace}})
+			}
+		}
+	}
+
+	return requests
+}
+
+// setCommandValue sets the value of a key in a command of the form
+// "key=value,key=value", keeping the other keys
+func setCommandValue(command string, key string, value string) string {
+	fields := []string{}
+	for _, field := range strings.Split(command, ",") {
+		if field == "" || strings.HasPrefix(field, key+"=") {
+			continue
+		}
+
+		fields = append(fields, field)
+	}
+
+	return strings.Join(append(fields, key+"="+value), ",")
+}
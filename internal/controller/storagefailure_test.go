@@ -0,0 +1,77 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+var _ = Describe("Storage Failure Test", func() {
+
+	DescribeTable("Chooses the severity for the health of a storage node",
+		func(status dwsv1alpha2.ResourceStatus, expected dwsv1alpha2.ResourceErrorSeverity) {
+			storage := &dwsv1alpha2.Storage{Status: dwsv1alpha2.StorageStatus{Status: status}}
+			Expect(storageHealth(storage)).To(Equal(expected))
+		},
+		Entry("when Ready", dwsv1alpha2.ReadyStatus, dwsv1alpha2.ResourceErrorSeverity("")),
+		Entry("before the first status", dwsv1alpha2.ResourceStatus(""), dwsv1alpha2.ResourceErrorSeverity("")),
+		Entry("when Degraded", dwsv1alpha2.DegradedStatus, dwsv1alpha2.SeverityMajor),
+		Entry("when Offline", dwsv1alpha2.OfflineStatus, dwsv1alpha2.SeverityFatal),
+		Entry("when Disabled", dwsv1alpha2.DisabledStatus, dwsv1alpha2.SeverityFatal),
+	)
+
+	It("Checks storage health only while the workflow uses its storage", func() {
+		Expect(checksStorageHealth(dwsv1alpha2.StateProposal)).To(BeFalse())
+		Expect(checksStorageHealth(dwsv1alpha2.StatePreRun)).To(BeTrue())
+		Expect(checksStorageHealth(dwsv1alpha2.StateTeardown)).To(BeFalse())
+	})
+
+	DescribeTable("Sets a value in a storage command",
+		func(command string, expected string) {
+			Expect(setCommandValue(command, "2", "Failed")).To(Equal(expected))
+		},
+		Entry("with an empty command", "", "2=Failed"),
+		Entry("with other keys", "0=Degraded", "0=Degraded,2=Failed"),
+		Entry("replacing the key", "2=Ready,3=Failed", "3=Failed,2=Failed"),
+	)
+	It("Reports when a storage node is due to fail", func() {
+		r := &WorkflowReconciler{Log: logr.Discard()}
+		start := metav1.NewMicroTime(time.Now().Add(-time.Minute))
+		workflow := &dwsv1alpha2.Workflow{Status: dwsv1alpha2.WorkflowStatus{DesiredStateChange: &start}}
+
+		driverStatus := &dwsv1alpha2.WorkflowDriverStatus{WatchState: dwsv1alpha2.StatePreRun}
+		next, err := r.failStorageAction(context.TODO(), workflow, driverStatus, map[string]string{"node": "rabbit-1", "at": "1h"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(next).To(BeNumerically("~", 59*time.Minute, time.Second))
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusRunning))
+
+		// The message stays the same from one reconcile to the next
+		expected := "Failing storage node 'rabbit-1' at " + start.Add(time.Hour).UTC().Format(time.RFC3339)
+		Expect(driverStatus.Message).To(Equal(expected))
+		_, err = r.failStorageAction(context.TODO(), workflow, driverStatus, map[string]string{"node": "rabbit-1", "at": "1h"})
+		Expect(err).ToNot(HaveOccurred())
+		Expect(driverStatus.Message).To(Equal(expected))
+	})
+})
@@ -1,5 +1,5 @@
 /*
-Copyright 2022-2023 Hewlett Packard Enterprise Development LP.
+Copyright 2022-2024 Hewlett Packard Enterprise Development LP.
 
 Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
@@ -54,6 +54,7 @@ var ctx context.Context
 var cancel context.CancelFunc
 var k8sClient client.Client
 var testEnv *envtest.Environment
+var wlmReconciler *WLMReconciler
 
 func TestAPIs(t *testing.T) {
 	RegisterFailHandler(Fail)
@@ -132,6 +133,23 @@ var _ = BeforeSuite(func() {
 	}).SetupWithManager(k8sManager)
 	Expect(err).ToNot(HaveOccurred())
 
+	err = (&ServersReconciler{
+		Client: k8sManager.GetClient(),
+		Log:    ctrl.Log.WithName("controllers").WithName("test-servers"),
+		Scheme: testEnv.Scheme,
+	}).SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
+	wlmReconciler = &WLMReconciler{
+		Client:    k8sManager.GetClient(),
+		Log:       ctrl.Log.WithName("controllers").WithName("test-wlm"),
+		Scheme:    testEnv.Scheme,
+		APIReader: k8sManager.GetAPIReader(),
+		WLMID:     simulatorWLMID,
+	}
+	err = wlmReconciler.SetupWithManager(k8sManager)
+	Expect(err).ToNot(HaveOccurred())
+
 	err = (&dwsctrls.WorkflowReconciler{
 		Client: k8sManager.GetClient(),
 		Log:    ctrl.Log.WithName("controllers").WithName("Workflow"),
@@ -0,0 +1,187 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// defaultPortsCooldown is the port cooldown of a topology that doesn't give one,
+// matching the SystemConfiguration default
+const defaultPortsCooldown = 60
+
+var topologyMatcher = regexp.MustCompile(`^(\d+)x(\d+)(?:\+(\d+))?$`)
+
+// SystemTopology is a compact description of a system: a number of storage
+// nodes that each have the same number of compute nodes attached, plus compute
+// nodes that aren't attached to any storage node.
+type SystemTopology struct {
+	StorageNodes     int
+	ComputesPerNode  int
+	ExternalComputes int
+	Ports            []intstr.IntOrString
+	PortsCooldown    int
+}
+
+// ParseSystemTopology parses a topology of the form
+// "<storage>x<computes>[+<external>][,ports=<ports>][,cooldown=<seconds>]".
+// For example, "4x16+8,ports=6000-6100,cooldown=30" describes 4 storage nodes
+// with 16 compute nodes each, 8 external compute nodes, and ports 6000 through
+// 6100 with a 30 second cooldown. Several port ranges are separated by ';'.
+func ParseSystemTopology(value string) (*SystemTopology, error) {
+	elements := strings.Split(value, ",")
+
+	matches := topologyMatcher.FindStringSubmatch(strings.TrimSpace(elements[0]))
+	if matches == nil {
+		return nil, fmt.Errorf("invalid topology '%s': expected '<storage>x<computes>[+<external>]'", value)
+	}
+
+	topology := &SystemTopology{PortsCooldown: defaultPortsCooldown}
+	topology.StorageNodes, _ = strconv.Atoi(matches[1])
+	topology.ComputesPerNode, _ = strconv.Atoi(matches[2])
+	if matches[3] != "" {
+		topology.ExternalComputes, _ = strconv.Atoi(matches[3])
+	}
+
+	for _, element := range elements[1:] {
+		key, option, _ := strings.Cut(strings.TrimSpace(element), "=")
+
+		switch key {
+		case "ports":
+			for _, ports := range strings.Split(option, ";") {
+				port, err := parsePorts(ports)
+				if err != nil {
+					return nil, fmt.Errorf("invalid topology '%s': %w", value, err)
+				}
+
+				topology.Ports = append(topology.Ports, port)
+			}
+		case "cooldown":
+			cooldown, err := strconv.Atoi(option)
+			if err != nil || cooldown < 0 {
+				return nil, fmt.Errorf("invalid topology '%s': invalid cooldown '%s'", value, option)
+			}
+
+			topology.PortsCooldown = cooldown
+		default:
+			return nil, fmt.Errorf("invalid topology '%s': unknown option '%s'", value, key)
+		}
+	}
+
+	return topology, nil
+}
+
+// parsePorts parses a single port or a range of ports of the form "START-END"
+func parsePorts(value string) (intstr.IntOrString, error) {
+	first, last, isRange := strings.Cut(value, "-")
+
+	start, err := strconv.Atoi(first)
+	if err != nil || start < 1 || start > 65535 {
+		return intstr.IntOrString{}, fmt.Errorf("invalid port '%s'", value)
+	}
+
+	if !isRange {
+		return intstr.FromInt(start), nil
+	}
+
+	end, err := strconv.Atoi(last)
+	if err != nil || end < start || end > 65535 {
+		return intstr.IntOrString{}, fmt.Errorf("invalid port range '%s'", value)
+	}
+
+	return intstr.FromString(value), nil
+}
+
+// storageNodeName returns the name of a storage node in the topology
+func storageNodeName(index int) string {
+	return fmt.Sprintf("rabbit-%d", index)
+}
+
+// computeNodeName returns the name of a compute node attached to a storage
+// node in the topology. Compute nodes are numbered across the whole system.
+func computeNodeName(index int) string {
+	return fmt.Sprintf("compute-%03d", index)
+}
+
+// externalComputeNodeName returns the name of an external compute node in the
+// topology
+func externalComputeNodeName(index int) string {
+	return fmt.Sprintf("external-%03d", index)
+}
+
+// SystemConfigurationSpec returns the SystemConfiguration spec that describes
+// the topology
+func (t *SystemTopology) SystemConfigurationSpec() dwsv1alpha2.SystemConfigurationSpec {
+	spec := dwsv1alpha2.SystemConfigurationSpec{
+		StorageNodes:           []dwsv1alpha2.SystemConfigurationStorageNode{},
+		ExternalComputeNodes:   []dwsv1alpha2.SystemConfigurationExternalComputeNode{},
+		Ports:                  t.Ports,
+		PortsCooldownInSeconds: t.PortsCooldown,
+	}
+
+	for i := 0; i < t.StorageNodes; i++ {
+		storageNode := dwsv1alpha2.SystemConfigurationStorageNode{
+			Type:           "Rabbit",
+			Name:           storageNodeName(i),
+			ComputesAccess: []dwsv1alpha2.SystemConfigurationComputeNodeReference{},
+		}
+
+		for j := 0; j < t.ComputesPerNode; j++ {
+			storageNode.ComputesAccess = append(storageNode.ComputesAccess, dwsv1alpha2.SystemConfigurationComputeNodeReference{
+				Name:  computeNodeName(i*t.ComputesPerNode + j),
+				Index: j,
+			})
+		}
+
+		spec.StorageNodes = append(spec.StorageNodes, storageNode)
+	}
+
+	for i := 0; i < t.ExternalComputes; i++ {
+		spec.ExternalComputeNodes = append(spec.ExternalComputeNodes, dwsv1alpha2.SystemConfigurationExternalComputeNode{
+			Name: externalComputeNodeName(i),
+		})
+	}
+
+	return spec
+}
+
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=systemconfigurations,verbs=get;list;watch;create;update;patch
+
+// ApplySystemConfiguration creates or updates the default SystemConfiguration
+// so that it describes the topology
+func ApplySystemConfiguration(ctx context.Context, c client.Client, topology *SystemTopology) error {
+	systemConfiguration := &dwsv1alpha2.SystemConfiguration{}
+	systemConfiguration.Name = systemConfigurationName.Name
+	systemConfiguration.Namespace = systemConfigurationName.Namespace
+
+	_, err := ctrl.CreateOrUpdate(ctx, c, systemConfiguration,
+		func() error {
+			systemConfiguration.Spec = topology.SystemConfigurationSpec()
+			return nil
+		})
+
+	return err
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+var _ = Describe("System Configuration Test", func() {
+
+	It("Parses a topology with every option", func() {
+		topology, err := ParseSystemTopology("4x16+8,ports=6000-6100;7000,cooldown=30")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(topology.StorageNodes).To(Equal(4))
+		Expect(topology.ComputesPerNode).To(Equal(16))
+		Expect(topology.ExternalComputes).To(Equal(8))
+		Expect(topology.Ports).To(Equal([]intstr.IntOrString{intstr.FromString("6000-6100"), intstr.FromInt(7000)}))
+		Expect(topology.PortsCooldown).To(Equal(30))
+	})
+
+	It("Parses a topology with defaults", func() {
+		topology, err := ParseSystemTopology("2x4")
+		Expect(err).ToNot(HaveOccurred())
+
+		Expect(topology.StorageNodes).To(Equal(2))
+		Expect(topology.ComputesPerNode).To(Equal(4))
+		Expect(topology.ExternalComputes).To(BeZero())
+		Expect(topology.Ports).To(BeEmpty())
+		Expect(topology.PortsCooldown).To(Equal(defaultPortsCooldown))
+	})
+
+	DescribeTable("Rejects invalid topologies",
+		func(value string) {
+			_, err := ParseSystemTopology(value)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("empty", ""),
+		Entry("missing computes", "4x"),
+		Entry("missing separator", "416"),
+		Entry("bad external", "4x16+"),
+		Entry("bad port", "4x16,ports=abc"),
+		Entry("port out of range", "4x16,ports=70000"),
+		Entry("reversed range", "4x16,ports=6100-6000"),
+		Entry("bad cooldown", "4x16,cooldown=-1"),
+		Entry("unknown option", "4x16,nodes=3"),
+	)
+
+	It("Generates the SystemConfiguration spec", func() {
+		topology, err := ParseSystemTopology("2x3+2,ports=6000-6100")
+		Expect(err).ToNot(HaveOccurred())
+
+		spec := topology.SystemConfigurationSpec()
+
+		Expect(spec.StorageNodes).To(HaveLen(2))
+		Expect(spec.StorageNodes[0].Name).To(Equal("rabbit-0"))
+		Expect(spec.StorageNodes[1].Name).To(Equal("rabbit-1"))
+
+		computes := spec.StorageNodes[1].ComputesAccess
+		Expect(computes).To(HaveLen(3))
+		for i, compute := range computes {
+			Expect(compute.Index).To(Equal(i))
+		}
+		Expect(computes[0].Name).To(Equal("compute-003"))
+		Expect(computes[2].Name).To(Equal("compute-005"))
+
+		Expect(spec.ExternalComputeNodes).To(HaveLen(2))
+		Expect(spec.ExternalComputeNodes[1].Name).To(Equal("external-001"))
+
+		Expect(spec.Ports).To(Equal([]intstr.IntOrString{intstr.FromString("6000-6100")}))
+		Expect(spec.PortsCooldownInSeconds).To(Equal(defaultPortsCooldown))
+	})
+})
@@ -0,0 +1,261 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// transferProgressInterval is how often the driver status of a transfer is
+// refreshed with its progress
+const transferProgressInterval = 5 * time.Second
+
+// transferKey identifies the transfer of a driver status entry
+type transferKey struct {
+	uid   types.UID
+	index int
+}
+
+// transfer is a simulated data movement of a number of bytes
+type transfer struct {
+	// state is the state of the workflow that the transfer belongs to
+	state dwsv1alpha2.WorkflowState
+
+	size      int64
+	remaining float64
+
+	// reported is when the progress of the transfer was last written to the
+	// driver status
+	reported time.Time
+}
+
+// done returns true once the whole transfer has been moved. Anything less
+// than a byte is rounding error.
+func (t *transfer) done() bool {
+	return t.remaining < 1
+}
+
+// transferPool shares a fixed bandwidth fairly among the simulated transfers
+// in progress. Each of the n transfers in progress moves data at 1/n of the
+// bandwidth, so transfers slow down as more of them run at once and speed up
+// as others finish. Transfers are indexed by the workflow they belong to and
+// the index of their directive.
+type transferPool struct {
+	sync.Mutex
+
+	// bandwidth is the bytes per second shared by the transfers
+	bandwidth float64
+
+	// updated is when the progress of the transfers was last worked out
+	updated time.Time
+
+	transfers map[transferKey]*transfer
+}
+
+func newTransferPool(bandwidth int64) *transferPool {
+	return &transferPool{bandwidth: float64(bandwidth), transfers: make(map[transferKey]*transfer)}
+}
+
+// active returns the transfers that are still in progress
+func (p *transferPool) active() []*transfer {
+	active := []*transfer{}
+	for _, t := range p.transfers {
+		if !t.done() {
+			active = append(active, t)
+		}
+	}
+
+	return active
+}
+
+// advance works out the progress of the transfers up to now. The time is
+// split at each point where a transfer finishes, since the share of the
+// bandwidth of the others grows from then on.
+func (p *transferPool) advance(now time.Time) {
+	elapsed := now.Sub(p.updated).Seconds()
+	if p.updated.IsZero() || elapsed < 0 {
+		elapsed = 0
+	}
+	p.updated = now
+
+	for elapsed > 0 {
+		active := p.active()
+		if len(active) == 0 {
+			return
+		}
+
+		rate := p.bandwidth / float64(len(active))
+		first := math.Inf(1)
+		for _, t := range active {
+			first = math.Min(first, t.remaining/rate)
+		}
+
+		step := math.Min(first, elapsed)
+		for _, t := range active {
+			t.remaining = math.Max(t.remaining-step*rate, 0)
+		}
+
+		// The transfer that finished first may be left with a rounding
+		// error, so finish it outright
+		if step == first {
+			for _, t := range active {
+				if t.remaining/rate < 1e-9 {
+					t.remaining = 0
+				}
+			}
+		}
+
+		elapsed -= step
+	}
+}
+
+// start begins a transfer of size bytes, unless it has already started
+func (p *transferPool) start(key transferKey, state dwsv1alpha2.WorkflowState, size int64, now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.advance(now)
+	if _, found := p.transfers[key]; !found {
+		p.transfers[key] = &transfer{state: state, size: size, remaining: float64(size)}
+	}
+}
+
+// progress returns the bytes moved so far by a transfer and its size, along
+// with the number of transfers in progress and the estimated time for the
+// transfer to finish at its current share of the bandwidth. Returns false if
+// the transfer hasn't been started.
+func (p *transferPool) progress(key transferKey, now time.Time) (int64, int64, int, time.Duration, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.advance(now)
+	t, found := p.transfers[key]
+	if !found {
+		return 0, 0, 0, 0, false
+	}
+
+	active := len(p.active())
+	if t.done() {
+		return t.size, t.size, active, 0, true
+	}
+
+	moved := t.size - int64(math.Ceil(t.remaining))
+	estimate := time.Duration(t.remaining / (p.bandwidth / float64(active)) * float64(time.Second))
+
+	return moved, t.size, active, estimate, true
+}
+
+// reportDue returns true if the progress of a transfer is due to be written to
+// the driver status again. Every write of the workflow status queues another
+// reconcile, so progress is only reported once per transferProgressInterval.
+func (p *transferPool) reportDue(key transferKey, now time.Time) bool {
+	p.Lock()
+	defer p.Unlock()
+
+	t, found := p.transfers[key]
+	if !found || now.Sub(t.reported) < transferProgressInterval {
+		return false
+	}
+
+	t.reported = now
+	return true
+}
+
+// abandon drops the transfers of a workflow that belong to a state other than
+// the workflow's desired state, such as those cut short by a move to Teardown,
+// so that they no longer take a share of the bandwidth
+func (p *transferPool) abandon(uid types.UID, desiredState dwsv1alpha2.WorkflowState, now time.Time) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.advance(now)
+	for key, t := range p.transfers {
+		if key.uid == uid && t.state != desiredState {
+			delete(p.transfers, key)
+		}
+	}
+}
+
+// forget drops all record of the transfers of a workflow
+func (p *transferPool) forget(uid types.UID, now time.Time) {
+	p.abandon(uid, "", now)
+}
+
+// transferAction simulates moving the number of bytes given by the size
+// argument, sharing the transfer bandwidth of the driver with the transfers
+// of every other workflow. The driver status reports the progress of the
+// transfer until it finishes, refreshed once per transferProgressInterval.
+// Returns the time until the progress should be reported again, or zero once
+// the driver status has reached a final result.
+func (r *WorkflowReconciler) transferAction(workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) time.Duration {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow), "index", driverStatus.DWDIndex)
+
+	if r.TransferBandwidth <= 0 {
+		setDriverError(driverStatus, dwsv1alpha2.NewResourceError("transfer action is disabled; no transfer bandwidth is configured").
+			WithUserMessage("transfer action is not enabled in the driver").WithUser().WithFatal())
+		return 0
+	}
+
+	if driverStatus.WatchState != dwsv1alpha2.StateDataIn && driverStatus.WatchState != dwsv1alpha2.StateDataOut {
+		setDriverError(driverStatus, dwsv1alpha2.NewResourceError("transfer action in state %s", driverStatus.WatchState).
+			WithUserMessage("transfer action is only valid in DataIn and DataOut").WithUser().WithFatal())
+		return 0
+	}
+
+	size, err := ParseCapacity(args["size"])
+	if err != nil {
+		setDriverError(driverStatus, dwsv1alpha2.NewResourceError("").WithError(err).
+			WithUserMessage("invalid 'size' argument '%s'", args["size"]).WithUser().WithFatal())
+		return 0
+	}
+
+	now := time.Now()
+	key := transferKey{uid: workflow.GetUID(), index: driverStatus.DWDIndex}
+	moved, total, active, estimate, found := r.transfers.progress(key, now)
+	if !found {
+		log.Info("Starting transfer", "size", size)
+		r.transfers.start(key, driverStatus.WatchState, size, now)
+		moved, total, active, estimate, _ = r.transfers.progress(key, now)
+	}
+
+	if moved < total {
+		if r.transfers.reportDue(key, now) || driverStatus.Status != dwsv1alpha2.StatusRunning {
+			driverStatus.Status = dwsv1alpha2.StatusRunning
+			driverStatus.Message = fmt.Sprintf("Transferring: %d of %d bytes (%d%%), %d transfers in progress",
+				moved, total, moved*100/total, active)
+			driverStatus.Error = ""
+		}
+
+		if estimate < transferProgressInterval {
+			return estimate + time.Millisecond
+		}
+		return transferProgressInterval
+	}
+
+	log.Info("Transfer complete", "size", total)
+	completeDriverStatus(driverStatus)
+	driverStatus.Message = fmt.Sprintf("Transferred %d bytes", total)
+
+	return 0
+}
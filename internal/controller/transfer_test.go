@@ -0,0 +1,116 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("Transfer Test", func() {
+
+	var pool *transferPool
+	var start time.Time
+
+	first := transferKey{uid: "first", index: 0}
+	second := transferKey{uid: "second", index: 1}
+
+	moved := func(key transferKey, at time.Duration) int64 {
+		bytes, _, _, _, found := pool.progress(key, start.Add(at))
+		Expect(found).To(BeTrue())
+		return bytes
+	}
+
+	BeforeEach(func() {
+		pool = newTransferPool(100)
+		start = time.Now()
+	})
+
+	It("Gives a lone transfer the whole bandwidth", func() {
+		pool.start(first, dwsv1alpha2.StateDataIn, 1000, start)
+
+		_, size, active, estimate, _ := pool.progress(first, start.Add(4*time.Second))
+		Expect(size).To(Equal(int64(1000)))
+		Expect(active).To(Equal(1))
+		Expect(estimate).To(Equal(6 * time.Second))
+		Expect(moved(first, 4*time.Second)).To(Equal(int64(400)))
+		Expect(moved(first, 20*time.Second)).To(Equal(int64(1000)))
+	})
+
+	It("Shares the bandwidth among the transfers in progress", func() {
+		pool.start(first, dwsv1alpha2.StateDataIn, 1000, start)
+		pool.start(second, dwsv1alpha2.StateDataOut, 300, start.Add(2*time.Second))
+
+		// Both transfers move 50 bytes per second until the second one
+		// finishes 8 seconds in
+		Expect(moved(first, 6*time.Second)).To(Equal(int64(400)))
+		Expect(moved(second, 6*time.Second)).To(Equal(int64(200)))
+
+		// From then on the first one has the whole bandwidth again
+		Expect(moved(second, 10*time.Second)).To(Equal(int64(300)))
+		Expect(moved(first, 10*time.Second)).To(Equal(int64(700)))
+		_, _, active, _, _ := pool.progress(first, start.Add(10*time.Second))
+		Expect(active).To(Equal(1))
+	})
+
+	It("Drops abandoned transfers from the pool", func() {
+		pool.start(first, dwsv1alpha2.StateDataIn, 1000, start)
+		pool.start(second, dwsv1alpha2.StateDataIn, 1000, start)
+
+		pool.abandon("second", dwsv1alpha2.StateDataIn, start.Add(time.Second))
+		_, _, active, _, _ := pool.progress(first, start.Add(time.Second))
+		Expect(active).To(Equal(2))
+
+		pool.abandon("second", dwsv1alpha2.StateTeardown, start.Add(2*time.Second))
+		_, _, _, _, found := pool.progress(second, start.Add(2*time.Second))
+		Expect(found).To(BeFalse())
+		Expect(moved(first, 4*time.Second)).To(Equal(int64(300)))
+
+		pool.forget("first", start.Add(5*time.Second))
+		_, _, _, _, found = pool.progress(first, start.Add(5*time.Second))
+		Expect(found).To(BeFalse())
+	})
+
+	It("Reports transfers in the driver status", func() {
+		r := &WorkflowReconciler{Log: logr.Discard(), TransferBandwidth: 1 << 40, transfers: newTransferPool(1 << 40)}
+		workflow := &dwsv1alpha2.Workflow{}
+		workflow.SetUID("uid")
+
+		driverStatus := &dwsv1alpha2.WorkflowDriverStatus{DWDIndex: 0, WatchState: dwsv1alpha2.StateDataIn}
+		next := r.transferAction(workflow, driverStatus, map[string]string{"size": "1PiB"})
+		Expect(next).To(Equal(transferProgressInterval))
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusRunning))
+		Expect(driverStatus.Message).To(HavePrefix("Transferring: "))
+		Expect(driverStatus.Message).To(HaveSuffix("of 1125899906842624 bytes (0%), 1 transfers in progress"))
+
+		// The progress isn't refreshed again until it's due
+		message := driverStatus.Message
+		time.Sleep(time.Millisecond)
+		r.transferAction(workflow, driverStatus, map[string]string{"size": "1PiB"})
+		Expect(driverStatus.Message).To(Equal(message))
+		Expect(r.transfers.reportDue(transferKey{uid: "uid", index: 0}, time.Now().Add(transferProgressInterval))).To(BeTrue())
+
+		driverStatus = &dwsv1alpha2.WorkflowDriverStatus{DWDIndex: 1, WatchState: dwsv1alpha2.StatePreRun}
+		Expect(r.transferAction(workflow, driverStatus, map[string]string{"size": "1GB"})).To(BeZero())
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusError))
+	})
+})
@@ -0,0 +1,486 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"github.com/go-logr/logr"
+	"github.com/prometheus/client_golang/prometheus"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/util/workqueue"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// Annotations that control how the WLM simulator drives a workflow
+const (
+	// wlmPauseAnnotation holds the workflow in its current state for as long
+	// as it is present
+	wlmPauseAnnotation = testerDomain + "wlm-pause"
+
+	// wlmStopAtAnnotation names the state that the workflow is left in once
+	// it is ready, rather than moving it on
+	wlmStopAtAnnotation = testerDomain + "wlm-stop-at"
+
+	// wlmDeleteDelayAnnotation is how long to wait after Teardown is ready
+	// before deleting the workflow
+	wlmDeleteDelayAnnotation = testerDomain + "wlm-delete-delay"
+
+	// wlmCancelAnnotation cancels the workflow, sending it straight to
+	// Teardown in a hurry
+	wlmCancelAnnotation = testerDomain + "wlm-cancel"
+)
+
+var wlmTeardownSeconds = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Name:    "dws_tester_wlm_teardown_seconds",
+		Help:    "Time from the WLM simulator requesting Teardown of a workflow to Teardown becoming ready.",
+		Buckets: prometheus.ExponentialBuckets(0.1, 2, 12),
+	},
+	[]string{"hurry"},
+)
+
+func init() {
+	metrics.Registry.MustRegister(wlmTeardownSeconds)
+}
+
+// wlmStates are the states that the WLM simulator moves a workflow through,
+// in order
+var wlmStates = []dwsv1alpha2.WorkflowState{
+	dwsv1alpha2.StateProposal,
+	dwsv1alpha2.StateSetup,
+	dwsv1alpha2.StateDataIn,
+	dwsv1alpha2.StatePreRun,
+	dwsv1alpha2.StatePostRun,
+	dwsv1alpha2.StateDataOut,
+	dwsv1alpha2.StateTeardown,
+}
+
+// nextWorkflowState returns the state that follows a state, or an empty state
+// for Teardown
+func nextWorkflowState(state dwsv1alpha2.WorkflowState) dwsv1alpha2.WorkflowState {
+	for i, s := range wlmStates[:len(wlmStates)-1] {
+		if s == state {
+			return wlmStates[i+1]
+		}
+	}
+
+	return ""
+}
+
+// parseWorkflowState parses the name of a workflow state
+func parseWorkflowState(value string) (dwsv1alpha2.WorkflowState, error) {
+	for _, state := range wlmStates {
+		if string(state) == value {
+			return state, nil
+		}
+	}
+
+	return "", fmt.Errorf("invalid workflow state '%s'", value)
+}
+
+// wlmStep is what the WLM simulator does next with a workflow
+type wlmStep struct {
+	// state is the desired state to move the workflow to, if any
+	state dwsv1alpha2.WorkflowState
+
+	// hurry sets the hurry flag along with a move to Teardown
+	hurry bool
+
+	// admit has the move to Setup wait for a free job slot
+	admit bool
+
+	// runJob has the move to PostRun wait for the compute job to finish
+	runJob bool
+
+	// delete has the workflow deleted
+	delete bool
+
+	// after is the time until the workflow should be looked at again, if
+	// nothing about it changes in the meantime
+	after time.Duration
+}
+
+// wlmNextStep decides what the WLM simulator does next with a workflow. A
+// workflow that is ready moves on to the next state, unless it is paused or
+// has reached the state it is to stop at, and a workflow that has finished
+// Teardown is deleted once its delete delay has passed. A queued workflow
+// waits in Proposal to be admitted to a job slot, and the compute job runs
+// before the move from PreRun to PostRun. A workflow whose job failed goes
+// from PostRun to Teardown in a hurry. A workflow that is
+// cancelled, or that has an error and isn't paused, goes to Teardown in a
+// hurry from whatever state it is in.
+func wlmNextStep(workflow *dwsv1alpha2.Workflow) (wlmStep, error) {
+	annotations := workflow.GetAnnotations()
+	hurrying := workflow.Spec.DesiredState == dwsv1alpha2.StateTeardown && workflow.Spec.Hurry
+
+	if _, found := annotations[wlmCancelAnnotation]; found && !hurrying {
+		return wlmStep{state: dwsv1alpha2.StateTeardown, hurry: true}, nil
+	}
+
+	if _, found := annotations[wlmPauseAnnotation]; found {
+		return wlmStep{}, nil
+	}
+
+	if workflow.Status.Status == dwsv1alpha2.StatusError && !hurrying {
+		return wlmStep{state: dwsv1alpha2.StateTeardown, hurry: true}, nil
+	}
+
+	// Wait for the drivers to finish the current state
+	if !workflow.Status.Ready || workflow.Status.State != workflow.Spec.DesiredState {
+		return wlmStep{}, nil
+	}
+
+	if value, found := annotations[wlmStopAtAnnotation]; found {
+		stopAt, err := parseWorkflowState(value)
+		if err != nil {
+			return wlmStep{}, err
+		}
+
+		if workflow.Status.State == stopAt {
+			return wlmStep{}, nil
+		}
+	}
+
+	if workflow.Status.State == dwsv1alpha2.StateProposal && isQueued(workflow) {
+		if _, err := workflowPriority(workflow); err != nil {
+			return wlmStep{}, err
+		}
+
+		return wlmStep{state: dwsv1alpha2.StateSetup, admit: true}, nil
+	}
+
+	if workflow.Status.State == dwsv1alpha2.StatePreRun {
+		_, finished := annotations[wlmJobFinishedAnnotation]
+		return wlmStep{state: dwsv1alpha2.StatePostRun, runJob: !finished}, nil
+	}
+
+	if _, failed := annotations[wlmJobErrorAnnotation]; failed && workflow.Status.State == dwsv1alpha2.StatePostRun {
+		return wlmStep{state: dwsv1alpha2.StateTeardown, hurry: true}, nil
+	}
+
+	if workflow.Status.State != dwsv1alpha2.StateTeardown {
+		return wlmStep{state: nextWorkflowState(workflow.Status.State)}, nil
+	}
+
+	delay := time.Duration(0)
+	if value, found := annotations[wlmDeleteDelayAnnotation]; found {
+		var err error
+		if delay, err = time.ParseDuration(value); err != nil || delay < 0 {
+			return wlmStep{}, fmt.Errorf("invalid delete delay '%s'", value)
+		}
+	}
+
+	ready := time.Now()
+	if workflow.Status.ReadyChange != nil {
+		ready = workflow.Status.ReadyChange.Time
+	}
+
+	if remaining := delay - time.Since(ready); remaining > 0 {
+		return wlmStep{after: remaining}, nil
+	}
+
+	return wlmStep{delete: true}, nil
+}
+
+// teardownDuration returns how long Teardown took, from the desired state
+// changing to Teardown to Teardown becoming ready
+func teardownDuration(workflow *dwsv1alpha2.Workflow) time.Duration {
+	if workflow.Status.DesiredStateChange == nil || workflow.Status.ReadyChange == nil {
+		return 0
+	}
+
+	return workflow.Status.ReadyChange.Sub(workflow.Status.DesiredStateChange.Time)
+}
+
+// WLMReconciler plays the part of the workload manager for the workflows with
+// its WLM ID. It moves each workflow through its states as the drivers finish
+// them, cancels it on an error, and deletes the workflow after Teardown. The
+// time taken by Teardown is recorded in the dws_tester_wlm_teardown_seconds
+// metric.
+type WLMReconciler struct {
+	client.Client
+	Log    logr.Logger
+	Scheme *runtime.Scheme
+
+	// APIReader reads the workflows that share the job slots straight from
+	// the API server, so that admissions made moments ago aren't missed. The
+	// client is used if this is nil.
+	APIReader client.Reader
+
+	// WLMID is the WLM ID of the workflows that the simulator drives
+	WLMID string
+
+	// Slots is the number of queued workflows that may run at once. Zero
+	// admits every queued workflow.
+	Slots int
+
+	// QueueOrder is the order in which queued workflows are admitted
+	QueueOrder QueueOrder
+
+	// Job is the body of the compute job run between PreRun and PostRun,
+	// unless a workflow has a job of its own. No job is run when this is
+	// empty.
+	Job string
+
+	// JobScripts are the scripts that a compute job may run
+	JobScripts []string
+
+	// JobRoots are the directories that a compute job may write to
+	JobRoots []string
+
+	jobs *jobTracker
+}
+
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=workflows,verbs=get;list;watch;update;patch;delete
+
+// Reconcile moves the workflow on to its next state once the drivers have
+// finished the current one
+func (r *WLMReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	log := r.Log.WithValues("Workflow", req.NamespacedName)
+
+	workflow := &dwsv1alpha2.Workflow{}
+	if err := r.Get(ctx, req.NamespacedName, workflow); err != nil {
+		if apierrors.IsNotFound(err) {
+			return ctrl.Result{}, r.updateQueueDepth(ctx)
+		}
+
+		return ctrl.Result{}, err
+	}
+
+	if !workflow.GetDeletionTimestamp().IsZero() {
+		r.jobs.forget(workflow.GetUID())
+		return ctrl.Result{}, r.updateQueueDepth(ctx)
+	}
+
+	if workflow.Spec.WLMID != r.WLMID {
+		return ctrl.Result{}, nil
+	}
+
+	// An invalid annotation leaves the workflow where it is until the
+	// annotation is fixed
+	step, err := wlmNextStep(workflow)
+	if err != nil {
+		log.Error(err, "Could not simulate WLM for workflow")
+		return ctrl.Result{}, nil
+	}
+
+	// A queued workflow that isn't up for admission may have left the queue
+	if isQueued(workflow) && !step.admit {
+		if err := r.updateQueueDepth(ctx); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	if step.admit {
+		admitted, err := r.admit(ctx, workflow)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if !admitted {
+			return ctrl.Result{RequeueAfter: wlmQueueInterval}, nil
+		}
+	}
+
+	if step.runJob {
+		done, err := r.runJob(workflow)
+		if err != nil {
+			log.Error(err, "Could not simulate WLM for workflow")
+			return ctrl.Result{}, nil
+		}
+		if !done {
+			return ctrl.Result{RequeueAfter: wlmJobInterval}, nil
+		}
+	}
+
+	switch {
+	case step.state != "":
+		workflow.Spec.DesiredState = step.state
+		workflow.Spec.Hurry = step.hurry
+		if err := r.Update(ctx, workflow); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+
+		// The job is done with once its result is saved along with the move
+		// to PostRun
+		if step.hurry || step.state == dwsv1alpha2.StatePostRun {
+			r.jobs.forget(workflow.GetUID())
+		}
+
+		if step.hurry {
+			log.Info("Cancelled workflow", "status", workflow.Status.Status, "message", workflow.Status.Message)
+		} else {
+			log.Info("Advanced workflow", "state", step.state)
+		}
+
+	case step.delete:
+		if err := r.Delete(ctx, workflow); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+
+		duration := teardownDuration(workflow)
+		wlmTeardownSeconds.WithLabelValues(strconv.FormatBool(workflow.Spec.Hurry)).Observe(duration.Seconds())
+		log.Info("Deleted workflow", "teardown", duration.String(), "hurry", workflow.Spec.Hurry)
+	}
+
+	return ctrl.Result{RequeueAfter: step.after}, nil
+}
+
+// admit checks whether a queued workflow has its turn at a free job slot. An
+// admitted workflow is given the admitted annotation, to be saved along with
+// its move to Setup.
+func (r *WLMReconciler) admit(ctx context.Context, workflow *dwsv1alpha2.Workflow) (bool, error) {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow))
+
+	queue, err := r.loadQueue(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	admitted, position := queue.admits(workflow, r.Slots)
+	if !admitted {
+		wlmQueueDepth.Set(float64(queue.depth))
+		log.Info("Workflow queued", "position", position, "slotsInUse", queue.inUse, "depth", queue.depth)
+		return false, nil
+	}
+
+	wlmQueueDepth.Set(float64(queue.depth - 1))
+	wait := time.Since(workflow.GetCreationTimestamp().Time)
+	wlmQueueWaitSeconds.Observe(wait.Seconds())
+	log.Info("Admitted workflow", "wait", wait.Round(time.Millisecond).String(), "slotsInUse", queue.inUse+1)
+
+	annotations := workflow.GetAnnotations()
+	annotations[wlmAdmittedAnnotation] = time.Now().Format(time.RFC3339)
+	workflow.SetAnnotations(annotations)
+
+	return true, nil
+}
+
+// loadQueue finds the state of the job queue in the workflows with the
+// simulator's WLM ID
+func (r *WLMReconciler) loadQueue(ctx context.Context) (*wlmQueue, error) {
+	reader := r.APIReader
+	if reader == nil {
+		reader = r.Client
+	}
+
+	workflowList := &dwsv1alpha2.WorkflowList{}
+	if err := reader.List(ctx, workflowList); err != nil {
+		return nil, err
+	}
+
+	workflows := []dwsv1alpha2.Workflow{}
+	for _, other := range workflowList.Items {
+		if other.Spec.WLMID == r.WLMID {
+			workflows = append(workflows, other)
+		}
+	}
+
+	return loadWLMQueue(workflows, r.QueueOrder), nil
+}
+
+// updateQueueDepth sets the queue depth metric from the job queue, for the
+// workflows that leave the queue without being admitted
+func (r *WLMReconciler) updateQueueDepth(ctx context.Context) error {
+	queue, err := r.loadQueue(ctx)
+	if err != nil {
+		return err
+	}
+
+	wlmQueueDepth.Set(float64(queue.depth))
+	return nil
+}
+
+// runJob runs the workflow's compute job in the background, with the
+// workflow's environment variables. Once the job has finished, the workflow
+// is given the finished annotation, and the error annotation if it failed, to
+// be saved along with its move to PostRun. Returns true once the job has
+// finished, or right away if the workflow has no job.
+func (r *WLMReconciler) runJob(workflow *dwsv1alpha2.Workflow) (bool, error) {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow))
+
+	value, found := workflow.GetAnnotations()[wlmJobAnnotation]
+	if !found {
+		value = r.Job
+	}
+	if value == "" {
+		return true, nil
+	}
+
+	job := r.jobs.get(workflow.GetUID())
+	if job == nil {
+		body, err := parseJobBody(value)
+		if err != nil {
+			return false, err
+		}
+
+		log.Info("Starting job", "job", value)
+		job = r.jobs.start(workflow.GetUID(), body, workflow.Status.Env, r.JobScripts, r.JobRoots)
+	}
+
+	done, err := job.finished()
+	if !done {
+		return false, nil
+	}
+
+	annotations := workflow.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[wlmJobFinishedAnnotation] = time.Now().Format(time.RFC3339)
+	if err != nil {
+		log.Info("Job failed", "job", value, "error", err.Error())
+		annotations[wlmJobErrorAnnotation] = err.Error()
+	} else {
+		log.Info("Job finished", "job", value)
+	}
+	workflow.SetAnnotations(annotations)
+
+	return true, nil
+}
+
+// forgetDeleted stops the job of a workflow that is gone. A workflow deleted
+// without its deletion being seen would otherwise keep its job.
+func (r *WLMReconciler) forgetDeleted(ctx context.Context, e event.DeleteEvent, q workqueue.RateLimitingInterface) {
+	r.jobs.forget(e.Object.GetUID())
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *WLMReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.jobs = newJobTracker()
+
+	isSimulated := predicate.NewPredicateFuncs(func(object client.Object) bool {
+		return object.(*dwsv1alpha2.Workflow).Spec.WLMID == r.WLMID
+	})
+
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("wlm").
+		For(&dwsv1alpha2.Workflow{}, builder.WithPredicates(isSimulated)).
+		Watches(&dwsv1alpha2.Workflow{}, handler.Funcs{DeleteFunc: r.forgetDeleted}, builder.WithPredicates(isSimulated)).
+		Complete(r)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"time"
+
+	"github.com/google/uuid"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+// simulatorWLMID is the WLM ID of the workflows driven by the WLM simulator in
+// the test environment. The workflows of the other specs use another WLM ID
+// so that they're left where they are.
+const simulatorWLMID = "simulator"
+
+var _ = Describe("WLM Simulator Test", func() {
+
+	var workflow *dwsv1alpha2.Workflow
+
+	BeforeEach(func() {
+		readyChange := metav1.NewMicroTime(time.Now())
+		workflow = &dwsv1alpha2.Workflow{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec:       dwsv1alpha2.WorkflowSpec{DesiredState: dwsv1alpha2.StateProposal},
+			Status: dwsv1alpha2.WorkflowStatus{
+				State:       dwsv1alpha2.StateProposal,
+				Ready:       true,
+				ReadyChange: &readyChange,
+			},
+		}
+	})
+
+	DescribeTable("Moves ready workflows to the next state",
+		func(state dwsv1alpha2.WorkflowState, next dwsv1alpha2.WorkflowState) {
+			workflow.Spec.DesiredState = state
+			workflow.Status.State = state
+
+			step, err := wlmNextStep(workflow)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(step).To(Equal(wlmStep{state: next}))
+		},
+		Entry("Proposal", dwsv1alpha2.StateProposal, dwsv1alpha2.StateSetup),
+		Entry("Setup", dwsv1alpha2.StateSetup, dwsv1alpha2.StateDataIn),
+		Entry("DataIn", dwsv1alpha2.StateDataIn, dwsv1alpha2.StatePreRun),
+		Entry("PostRun", dwsv1alpha2.StatePostRun, dwsv1alpha2.StateDataOut),
+		Entry("DataOut", dwsv1alpha2.StateDataOut, dwsv1alpha2.StateTeardown),
+	)
+
+	It("Moves from PreRun to PostRun once the job has finished", func() {
+		workflow.Spec.DesiredState = dwsv1alpha2.StatePreRun
+		workflow.Status.State = dwsv1alpha2.StatePreRun
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{state: dwsv1alpha2.StatePostRun, runJob: true}))
+
+		workflow.SetAnnotations(map[string]string{wlmJobFinishedAnnotation: "now"})
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{state: dwsv1alpha2.StatePostRun}))
+	})
+
+	It("Waits for the drivers", func() {
+		workflow.Status.Ready = false
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{}))
+
+		workflow.Status.Ready = true
+		workflow.Spec.DesiredState = dwsv1alpha2.StateSetup
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{}))
+	})
+
+	It("Holds paused workflows", func() {
+		workflow.SetAnnotations(map[string]string{wlmPauseAnnotation: "true"})
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{}))
+	})
+
+	It("Stops at the requested state", func() {
+		workflow.SetAnnotations(map[string]string{wlmStopAtAnnotation: "Proposal"})
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{}))
+
+		workflow.SetAnnotations(map[string]string{wlmStopAtAnnotation: "PreRun"})
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{state: dwsv1alpha2.StateSetup}))
+
+		workflow.SetAnnotations(map[string]string{wlmStopAtAnnotation: "Running"})
+		_, err := wlmNextStep(workflow)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Deletes workflows after Teardown", func() {
+		workflow.Spec.DesiredState = dwsv1alpha2.StateTeardown
+		workflow.Status.State = dwsv1alpha2.StateTeardown
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{delete: true}))
+
+		workflow.SetAnnotations(map[string]string{wlmDeleteDelayAnnotation: "1m"})
+		step, err := wlmNextStep(workflow)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(step.delete).To(BeFalse())
+		Expect(step.after).To(BeNumerically("~", time.Minute, time.Second))
+
+		workflow.Status.ReadyChange.Time = time.Now().Add(-2 * time.Minute)
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{delete: true}))
+
+		workflow.SetAnnotations(map[string]string{wlmDeleteDelayAnnotation: "soon"})
+		_, err = wlmNextStep(workflow)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Cancels workflows with errors", func() {
+		workflow.Spec.DesiredState = dwsv1alpha2.StateDataIn
+		workflow.Status.State = dwsv1alpha2.StateDataIn
+		workflow.Status.Ready = false
+		workflow.Status.Status = dwsv1alpha2.StatusError
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{state: dwsv1alpha2.StateTeardown, hurry: true}))
+
+		workflow.SetAnnotations(map[string]string{wlmPauseAnnotation: "true"})
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{}))
+
+		workflow.SetAnnotations(nil)
+		workflow.Spec.DesiredState = dwsv1alpha2.StateTeardown
+		workflow.Spec.Hurry = true
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{}))
+	})
+
+	It("Cancels workflows on request", func() {
+		workflow.Status.Ready = false
+		workflow.SetAnnotations(map[string]string{wlmCancelAnnotation: "true", wlmPauseAnnotation: "true"})
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{state: dwsv1alpha2.StateTeardown, hurry: true}))
+
+		workflow.Spec.DesiredState = dwsv1alpha2.StateTeardown
+		workflow.Spec.Hurry = true
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{}))
+	})
+
+	It("Measures Teardown", func() {
+		Expect(teardownDuration(workflow)).To(BeZero())
+
+		requested := metav1.NewMicroTime(workflow.Status.ReadyChange.Add(-5 * time.Second))
+		workflow.Status.DesiredStateChange = &requested
+		Expect(teardownDuration(workflow)).To(Equal(5 * time.Second))
+	})
+})
+
+var _ = Describe("WLM Reconciler Test", func() {
+
+	teardowns := func() uint64 {
+		metric := &dto.Metric{}
+		Expect(wlmTeardownSeconds.WithLabelValues("false").(prometheus.Histogram).Write(metric)).To(Succeed())
+		return metric.GetHistogram().GetSampleCount()
+	}
+
+	queueDepth := func() float64 {
+		metric := &dto.Metric{}
+		Expect(wlmQueueDepth.Write(metric)).To(Succeed())
+		return metric.GetGauge().GetValue()
+	}
+
+	newWorkflow := func(annotations map[string]string, directive string) *dwsv1alpha2.Workflow {
+		return &dwsv1alpha2.Workflow{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "wlm-" + uuid.NewString()[0:8],
+				Namespace:   corev1.NamespaceDefault,
+				Annotations: annotations,
+			},
+			Spec: dwsv1alpha2.WorkflowSpec{
+				DesiredState: dwsv1alpha2.StateProposal,
+				WLMID:        simulatorWLMID,
+				JobID:        intstr.FromString("wlm job 442"),
+				DWDirectives: []string{directive},
+			},
+		}
+	}
+
+	It("Counts the queued workflows until they leave the queue", func() {
+		workflow := newWorkflow(map[string]string{wlmQueueAnnotation: "true", wlmPauseAnnotation: "true"}, "#DW Proposal action=complete")
+		Expect(k8sClient.Create(context.TODO(), workflow)).To(Succeed())
+		Eventually(queueDepth).Should(Equal(1.0))
+
+		Expect(k8sClient.Delete(context.TODO(), workflow)).To(Succeed())
+		Eventually(queueDepth).Should(BeZero())
+		Eventually(func() error {
+			return k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(workflow), workflow)
+		}).ShouldNot(Succeed())
+	})
+
+	It("Runs a workflow through every state and deletes it", func() {
+		workflow := newWorkflow(map[string]string{
+			wlmJobAnnotation:    "sleep:100ms",
+			wlmStopAtAnnotation: string(dwsv1alpha2.StatePostRun),
+		}, "#DW PreRun action=complete")
+		Expect(k8sClient.Create(context.TODO(), workflow)).To(Succeed())
+
+		// The job runs between PreRun and PostRun
+		Eventually(func(g Gomega) {
+			g.Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(workflow), workflow)).To(Succeed())
+			g.Expect(workflow.Status.State).To(Equal(dwsv1alpha2.StatePostRun))
+			g.Expect(workflow.Status.Ready).To(BeTrue())
+		}).WithTimeout(10 * time.Second).Should(Succeed())
+		Expect(workflow.GetAnnotations()).To(HaveKey(wlmJobFinishedAnnotation))
+		Expect(workflow.GetAnnotations()).ToNot(HaveKey(wlmJobErrorAnnotation))
+		Expect(wlmReconciler.jobs.get(workflow.GetUID())).To(BeNil())
+
+		driverStatus := workflow.Status.Drivers[0]
+		Expect(driverStatus.WatchState).To(Equal(dwsv1alpha2.StatePreRun))
+		Expect(driverStatus.Completed).To(BeTrue())
+
+		// Without the stop, the workflow goes on through Teardown and is
+		// deleted
+		before := teardowns()
+		Eventually(func() error {
+			Expect(k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(workflow), workflow)).To(Succeed())
+			annotations := workflow.GetAnnotations()
+			delete(annotations, wlmStopAtAnnotation)
+			workflow.SetAnnotations(annotations)
+			return k8sClient.Update(context.TODO(), workflow)
+		}).Should(Succeed())
+
+		Eventually(func() error {
+			return k8sClient.Get(context.TODO(), client.ObjectKeyFromObject(workflow), workflow)
+		}).WithTimeout(10 * time.Second).ShouldNot(Succeed())
+		Expect(teardowns()).To(Equal(before + 1))
+	})
+})
@@ -0,0 +1,265 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Annotations for the compute job that the WLM simulator runs between PreRun
+// and PostRun
+const (
+	// wlmJobAnnotation is the job body of the workflow, in place of the
+	// default job body of the simulator
+	wlmJobAnnotation = testerDomain + "wlm-job"
+
+	// wlmJobFinishedAnnotation records when the job finished
+	wlmJobFinishedAnnotation = testerDomain + "wlm-job-finished"
+
+	// wlmJobErrorAnnotation records why the job failed
+	wlmJobErrorAnnotation = testerDomain + "wlm-job-error"
+)
+
+// wlmJobInterval is how often a running job is checked for completion
+const wlmJobInterval = time.Second
+
+// jobWriteBufferSize is the size of the chunks written by a write job. The job
+// checks for cancellation between chunks.
+const jobWriteBufferSize = 1024 * 1024
+
+// jobOutputLimit is how much of the output of a failed script is kept in its
+// error
+const jobOutputLimit = 256
+
+// jobBody is the work done by a simulated compute job
+type jobBody struct {
+	// kind is "sleep", "script", or "write"
+	kind string
+
+	// duration is how long a sleep job takes
+	duration time.Duration
+
+	// path is the script run by a script job, or the file written by a write
+	// job before its environment variables are expanded
+	path string
+
+	// size is the number of bytes written by a write job
+	size int64
+}
+
+// parseJobBody parses a job body: "sleep:<duration>", "script:<path>", or
+// "write:<path>:<size>". The path of a write job may refer to the workflow's
+// environment variables, such as "$DW_JOB_scratch/out".
+func parseJobBody(value string) (*jobBody, error) {
+	kind, rest, _ := strings.Cut(value, ":")
+
+	switch kind {
+	case "sleep":
+		duration, err := time.ParseDuration(rest)
+		if err != nil || duration < 0 {
+			return nil, fmt.Errorf("invalid job sleep '%s'", value)
+		}
+
+		return &jobBody{kind: kind, duration: duration}, nil
+
+	case "script":
+		if rest == "" {
+			return nil, fmt.Errorf("invalid job script '%s'", value)
+		}
+
+		return &jobBody{kind: kind, path: rest}, nil
+
+	case "write":
+		i := strings.LastIndex(rest, ":")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid job write '%s'", value)
+		}
+
+		size, err := ParseCapacity(rest[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid job write '%s': %w", value, err)
+		}
+
+		return &jobBody{kind: kind, path: rest[:i], size: size}, nil
+	}
+
+	return nil, fmt.Errorf("invalid job '%s'", value)
+}
+
+// ValidateJob checks a job body given to the WLM simulator. An empty job body
+// is valid, and runs no job.
+func ValidateJob(value string) error {
+	if value == "" {
+		return nil
+	}
+
+	_, err := parseJobBody(value)
+	return err
+}
+
+// run does the work of the job with the workflow's environment variables.
+// Scripts must be in the allowed scripts, and files may only be written under
+// the roots.
+func (b *jobBody) run(ctx context.Context, env map[string]string, scripts []string, roots []string) error {
+	switch b.kind {
+	case "sleep":
+		timer := time.NewTimer(b.duration)
+		defer timer.Stop()
+
+		select {
+		case <-timer.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+	case "script":
+		if !containsString(scripts, filepath.Clean(b.path)) {
+			return fmt.Errorf("script '%s' is not allowed", b.path)
+		}
+
+		cmd := exec.CommandContext(ctx, b.path)
+		cmd.Env = os.Environ()
+		for name, value := range env {
+			cmd.Env = append(cmd.Env, name+"="+value)
+		}
+
+		if output, err := cmd.CombinedOutput(); err != nil {
+			if len(output) > jobOutputLimit {
+				output = output[len(output)-jobOutputLimit:]
+			}
+
+			return fmt.Errorf("script '%s' failed: %w: %s", b.path, err, strings.TrimSpace(string(output)))
+		}
+
+		return nil
+
+	case "write":
+		return writeJobFile(ctx, os.Expand(b.path, func(name string) string { return env[name] }), b.size, roots)
+	}
+
+	return fmt.Errorf("unknown job '%s'", b.kind)
+}
+
+// writeJobFile writes size bytes to the file at path, which must be under one
+// of the roots
+func writeJobFile(ctx context.Context, path string, size int64, roots []string) error {
+	if !filepath.IsAbs(path) || !withinRoots(filepath.Clean(path), roots) {
+		return fmt.Errorf("path '%s' is not under a job root: %s", path, strings.Join(roots, ","))
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, jobWriteBufferSize)
+	for written := int64(0); written < size; {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		chunk := buffer
+		if remaining := size - written; remaining < int64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+
+		n, err := file.Write(chunk)
+		if err != nil {
+			return err
+		}
+		written += int64(n)
+	}
+
+	return file.Close()
+}
+
+// jobRun is a job running in the background on behalf of a workflow
+type jobRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// finished returns true if the job has stopped, along with the error that
+// stopped it, if any
+func (j *jobRun) finished() (bool, error) {
+	select {
+	case <-j.done:
+		return true, j.err
+	default:
+		return false, nil
+	}
+}
+
+// jobTracker keeps track of the jobs started by the WLM simulator, indexed by
+// the workflow they belong to
+type jobTracker struct {
+	sync.Mutex
+	jobs map[types.UID]*jobRun
+}
+
+func newJobTracker() *jobTracker {
+	return &jobTracker{jobs: make(map[types.UID]*jobRun)}
+}
+
+// get returns the job for a workflow, or nil if one hasn't been started
+func (t *jobTracker) get(uid types.UID) *jobRun {
+	t.Lock()
+	defer t.Unlock()
+
+	return t.jobs[uid]
+}
+
+// start runs a job in the background and records it against the workflow
+func (t *jobTracker) start(uid types.UID, body *jobBody, env map[string]string, scripts []string, roots []string) *jobRun {
+	t.Lock()
+	defer t.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	job := &jobRun{cancel: cancel, done: make(chan struct{})}
+	t.jobs[uid] = job
+
+	go func() {
+		defer close(job.done)
+		job.err = body.run(ctx, env, scripts, roots)
+	}()
+
+	return job
+}
+
+// forget stops the job of a workflow if it is still running and drops all
+// record of it
+func (t *jobTracker) forget(uid types.UID) {
+	t.Lock()
+	defer t.Unlock()
+
+	if job, found := t.jobs[uid]; found {
+		job.cancel()
+		delete(t.jobs, uid)
+	}
+}
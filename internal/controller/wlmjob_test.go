@@ -0,0 +1,125 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("WLM Job Test", func() {
+
+	DescribeTable("Parses job bodies",
+		func(value string, expected *jobBody, valid bool) {
+			body, err := parseJobBody(value)
+			if !valid {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(body).To(Equal(expected))
+		},
+		Entry("sleep", "sleep:30s", &jobBody{kind: "sleep", duration: 30 * time.Second}, true),
+		Entry("script", "script:/opt/job.sh", &jobBody{kind: "script", path: "/opt/job.sh"}, true),
+		Entry("write", "write:$DW_JOB_scratch/out:1KB", &jobBody{kind: "write", path: "$DW_JOB_scratch/out", size: 1000}, true),
+		Entry("bad sleep", "sleep:soon", nil, false),
+		Entry("no script", "script:", nil, false),
+		Entry("no size", "write:/tmp/out", nil, false),
+		Entry("unknown", "compile:all", nil, false),
+	)
+
+	It("Writes files under the job roots with the workflow's environment", func() {
+		root := GinkgoT().TempDir()
+		env := map[string]string{"DW_JOB_scratch": root}
+
+		body, err := parseJobBody("write:$DW_JOB_scratch/out:3MiB")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(body.run(context.TODO(), env, nil, []string{root})).To(Succeed())
+
+		info, err := os.Stat(filepath.Join(root, "out"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(info.Size()).To(Equal(int64(3 * 1024 * 1024)))
+
+		Expect(body.run(context.TODO(), map[string]string{}, nil, []string{root})).To(MatchError(ContainSubstring("is not under a job root")))
+	})
+
+	It("Runs only allowed scripts with the workflow's environment", func() {
+		root := GinkgoT().TempDir()
+		script := filepath.Join(root, "job.sh")
+		Expect(os.WriteFile(script, []byte("#!/bin/sh\necho \"mount is $DW_JOB_scratch\"\n[ -n \"$DW_JOB_scratch\" ]\n"), 0755)).To(Succeed())
+
+		body := &jobBody{kind: "script", path: script}
+		Expect(body.run(context.TODO(), map[string]string{"DW_JOB_scratch": "/mnt/scratch"}, []string{script}, nil)).To(Succeed())
+		Expect(body.run(context.TODO(), map[string]string{}, []string{script}, nil)).To(MatchError(ContainSubstring("mount is")))
+		Expect(body.run(context.TODO(), map[string]string{}, nil, nil)).To(MatchError(ContainSubstring("is not allowed")))
+	})
+
+	It("Tracks jobs in the background", func() {
+		jobs := newJobTracker()
+		job := jobs.start("uid", &jobBody{kind: "sleep", duration: time.Hour}, nil, nil, nil)
+		Expect(jobs.get("uid")).To(Equal(job))
+
+		done, _ := job.finished()
+		Expect(done).To(BeFalse())
+
+		jobs.forget("uid")
+		Eventually(func() bool {
+			done, _ := job.finished()
+			return done
+		}).Should(BeTrue())
+		Expect(jobs.get("uid")).To(BeNil())
+	})
+
+	It("Stops the jobs of deleted workflows", func() {
+		r := &WLMReconciler{jobs: newJobTracker()}
+		workflow := &dwsv1alpha2.Workflow{ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default", UID: "uid"}}
+		job := r.jobs.start(workflow.GetUID(), &jobBody{kind: "sleep", duration: time.Hour}, nil, nil, nil)
+
+		r.forgetDeleted(context.TODO(), event.DeleteEvent{Object: workflow}, nil)
+		Eventually(func() bool {
+			done, _ := job.finished()
+			return done
+		}).Should(BeTrue())
+		Expect(r.jobs.get(workflow.GetUID())).To(BeNil())
+	})
+
+	It("Runs the job between PreRun and PostRun", func() {
+		workflow := &dwsv1alpha2.Workflow{
+			ObjectMeta: metav1.ObjectMeta{Name: "test", Namespace: "default"},
+			Spec:       dwsv1alpha2.WorkflowSpec{DesiredState: dwsv1alpha2.StatePreRun},
+			Status:     dwsv1alpha2.WorkflowStatus{State: dwsv1alpha2.StatePreRun, Ready: true},
+		}
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{state: dwsv1alpha2.StatePostRun, runJob: true}))
+
+		workflow.SetAnnotations(map[string]string{wlmJobFinishedAnnotation: "now", wlmJobErrorAnnotation: "failed"})
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{state: dwsv1alpha2.StatePostRun}))
+
+		workflow.Spec.DesiredState = dwsv1alpha2.StatePostRun
+		workflow.Status.State = dwsv1alpha2.StatePostRun
+		Expect(wlmNextStep(workflow)).To(Equal(wlmStep{state: dwsv1alpha2.StateTeardown, hurry: true}))
+	})
+})
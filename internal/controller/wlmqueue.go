@@ -0,0 +1,191 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+// Annotations for the job queue of the WLM simulator
+const (
+	// wlmQueueAnnotation holds the workflow in Proposal until it is admitted
+	// to one of the job slots
+	wlmQueueAnnotation = testerDomain + "wlm-queue"
+
+	// wlmPriorityAnnotation is the priority of a queued workflow, where higher
+	// priorities are admitted first
+	wlmPriorityAnnotation = testerDomain + "wlm-priority"
+
+	// wlmAdmittedAnnotation records when a queued workflow was admitted
+	wlmAdmittedAnnotation = testerDomain + "wlm-admitted"
+)
+
+// wlmQueueInterval is how often a queued workflow checks for a free job slot
+const wlmQueueInterval = time.Second
+
+var (
+	wlmQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "dws_tester_wlm_queue_depth",
+			Help: "Number of queued workflows waiting for a job slot in the WLM simulator.",
+		},
+	)
+
+	wlmQueueWaitSeconds = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "dws_tester_wlm_queue_wait_seconds",
+			Help:    "Time from the creation of a queued workflow to its admission to a job slot.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 2, 16),
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(wlmQueueDepth, wlmQueueWaitSeconds)
+}
+
+// QueueOrder is the order in which queued workflows are admitted
+type QueueOrder string
+
+const (
+	// QueueFIFO admits the workflows in the order that they were created
+	QueueFIFO QueueOrder = "fifo"
+
+	// QueuePriority admits the workflows with the highest priority first, and
+	// those with the same priority in the order that they were created
+	QueuePriority QueueOrder = "priority"
+)
+
+// ParseQueueOrder parses the order in which queued workflows are admitted
+func ParseQueueOrder(value string) (QueueOrder, error) {
+	switch order := QueueOrder(strings.ToLower(value)); order {
+	case QueueFIFO, QueuePriority:
+		return order, nil
+	}
+
+	return "", fmt.Errorf("unknown queue order: %s", value)
+}
+
+// isQueued returns true for a workflow that waits in the queue and hasn't
+// been admitted yet
+func isQueued(workflow *dwsv1alpha2.Workflow) bool {
+	annotations := workflow.GetAnnotations()
+	_, queued := annotations[wlmQueueAnnotation]
+	_, admitted := annotations[wlmAdmittedAnnotation]
+
+	return queued && !admitted
+}
+
+// workflowPriority returns the priority of a queued workflow, which is zero if
+// it isn't given
+func workflowPriority(workflow *dwsv1alpha2.Workflow) (int, error) {
+	value, found := workflow.GetAnnotations()[wlmPriorityAnnotation]
+	if !found {
+		return 0, nil
+	}
+
+	priority, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid priority '%s'", value)
+	}
+
+	return priority, nil
+}
+
+// wlmQueue is the state of the job queue, as found in the workflows of the WLM
+// simulator
+type wlmQueue struct {
+	// inUse is the number of job slots held by admitted workflows
+	inUse int
+
+	// depth is the number of queued workflows that haven't been admitted
+	depth int
+
+	// waiting are the queued workflows that are ready to be admitted, in the
+	// order that they are to be admitted
+	waiting []*dwsv1alpha2.Workflow
+}
+
+// loadWLMQueue finds the state of the job queue in the workflows of the WLM
+// simulator. An admitted workflow holds its job slot until it goes to
+// Teardown.
+func loadWLMQueue(workflows []dwsv1alpha2.Workflow, order QueueOrder) *wlmQueue {
+	queue := &wlmQueue{}
+
+	for i := range workflows {
+		workflow := &workflows[i]
+		if !workflow.GetDeletionTimestamp().IsZero() || workflow.Spec.DesiredState == dwsv1alpha2.StateTeardown {
+			continue
+		}
+
+		if _, admitted := workflow.GetAnnotations()[wlmAdmittedAnnotation]; admitted {
+			queue.inUse++
+			continue
+		}
+
+		if !isQueued(workflow) {
+			continue
+		}
+
+		queue.depth++
+		if step, err := wlmNextStep(workflow); err == nil && step.admit {
+			queue.waiting = append(queue.waiting, workflow)
+		}
+	}
+
+	sort.SliceStable(queue.waiting, func(i, j int) bool {
+		a, b := queue.waiting[i], queue.waiting[j]
+		if order == QueuePriority {
+			pa, _ := workflowPriority(a)
+			pb, _ := workflowPriority(b)
+			if pa != pb {
+				return pa > pb
+			}
+		}
+
+		if !a.CreationTimestamp.Equal(&b.CreationTimestamp) {
+			return a.CreationTimestamp.Before(&b.CreationTimestamp)
+		}
+
+		return a.Namespace+"/"+a.Name < b.Namespace+"/"+b.Name
+	})
+
+	return queue
+}
+
+// admits returns true if the workflow is among the waiting workflows that fit
+// in the free job slots. A limit of zero slots admits every workflow. The
+// position of the workflow in the queue is returned as well.
+func (q *wlmQueue) admits(workflow *dwsv1alpha2.Workflow, slots int) (bool, int) {
+	position := len(q.waiting)
+	for i, waiting := range q.waiting {
+		if waiting.GetUID() == workflow.GetUID() {
+			position = i
+			break
+		}
+	}
+
+	return slots == 0 || q.inUse+position < slots, position
+}
@@ -0,0 +1,129 @@
+/*
+Copyright 2024 Hewlett Packard Enterprise Development LP.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"strconv"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
+)
+
+var _ = Describe("WLM Queue Test", func() {
+
+	created := time.Now()
+
+	// newWorkflow returns a workflow created i seconds after the others that
+	// is ready in the given state
+	newWorkflow := func(i int, state dwsv1alpha2.WorkflowState, annotations map[string]string) dwsv1alpha2.Workflow {
+		return dwsv1alpha2.Workflow{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "test-" + strconv.Itoa(i),
+				Namespace:         "default",
+				UID:               types.UID(strconv.Itoa(i)),
+				CreationTimestamp: metav1.NewTime(created.Add(time.Duration(i) * time.Second)),
+				Annotations:       annotations,
+			},
+			Spec:   dwsv1alpha2.WorkflowSpec{DesiredState: state},
+			Status: dwsv1alpha2.WorkflowStatus{State: state, Ready: true},
+		}
+	}
+
+	queued := func(priority string) map[string]string {
+		return map[string]string{wlmQueueAnnotation: "true", wlmPriorityAnnotation: priority}
+	}
+
+	names := func(queue *wlmQueue) []string {
+		list := []string{}
+		for _, workflow := range queue.waiting {
+			list = append(list, workflow.Name)
+		}
+		return list
+	}
+
+	var workflows []dwsv1alpha2.Workflow
+
+	BeforeEach(func() {
+		workflows = []dwsv1alpha2.Workflow{
+			newWorkflow(0, dwsv1alpha2.StatePreRun, map[string]string{wlmQueueAnnotation: "true", wlmAdmittedAnnotation: "now"}),
+			newWorkflow(1, dwsv1alpha2.StateTeardown, map[string]string{wlmQueueAnnotation: "true", wlmAdmittedAnnotation: "now"}),
+			newWorkflow(2, dwsv1alpha2.StateProposal, queued("1")),
+			newWorkflow(3, dwsv1alpha2.StateProposal, queued("5")),
+			newWorkflow(4, dwsv1alpha2.StateProposal, queued("1")),
+			newWorkflow(5, dwsv1alpha2.StateProposal, nil),
+		}
+		workflows[4].Status.Ready = false
+	})
+
+	DescribeTable("Parses queue orders",
+		func(value string, expected QueueOrder, valid bool) {
+			order, err := ParseQueueOrder(value)
+			if !valid {
+				Expect(err).To(HaveOccurred())
+				return
+			}
+
+			Expect(err).ToNot(HaveOccurred())
+			Expect(order).To(Equal(expected))
+		},
+		Entry("fifo", "fifo", QueueFIFO, true),
+		Entry("priority", "Priority", QueuePriority, true),
+		Entry("unknown", "random", QueueOrder(""), false),
+	)
+
+	It("Holds queued workflows in Proposal for admission", func() {
+		step, err := wlmNextStep(&workflows[2])
+		Expect(err).ToNot(HaveOccurred())
+		Expect(step).To(Equal(wlmStep{state: dwsv1alpha2.StateSetup, admit: true}))
+
+		Expect(wlmNextStep(&workflows[5])).To(Equal(wlmStep{state: dwsv1alpha2.StateSetup}))
+
+		workflows[2].Annotations[wlmPriorityAnnotation] = "high"
+		_, err = wlmNextStep(&workflows[2])
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("Admits workflows in FIFO order", func() {
+		queue := loadWLMQueue(workflows, QueueFIFO)
+		Expect(queue.inUse).To(Equal(1))
+		Expect(queue.depth).To(Equal(3))
+		Expect(names(queue)).To(Equal([]string{"test-2", "test-3"}))
+
+		Expect(queue.admits(&workflows[2], 2)).To(Equal(true))
+		admitted, position := queue.admits(&workflows[3], 2)
+		Expect(admitted).To(BeFalse())
+		Expect(position).To(Equal(1))
+
+		admitted, _ = queue.admits(&workflows[3], 0)
+		Expect(admitted).To(BeTrue())
+	})
+
+	It("Admits workflows in priority order", func() {
+		queue := loadWLMQueue(workflows, QueuePriority)
+		Expect(names(queue)).To(Equal([]string{"test-3", "test-2"}))
+
+		admitted, _ := queue.admits(&workflows[3], 2)
+		Expect(admitted).To(BeTrue())
+		admitted, _ = queue.admits(&workflows[2], 2)
+		Expect(admitted).To(BeFalse())
+	})
+})
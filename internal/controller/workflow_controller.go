@@ -1,5 +1,5 @@
 /*
-Copyright 2022-2023 Hewlett Packard Enterprise Development LP.
+Copyright 2022-2024 Hewlett Packard Enterprise Development LP.
 
 Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
@@ -18,7 +18,13 @@ package controller
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
 	"strings"
+	"time"
 
 	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
 	dwdparse "github.com/DataWorkflowServices/dws/utils/dwdparse"
@@ -27,19 +33,86 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
 )
 
 const DRIVERID string = "tester"
 
+// testerDomain prefixes the names of the annotations, labels, and finalizers
+// used by the driver
+const testerDomain = "tester.dataworkflowservices.github.io/"
+
+// crashedAnnotationPrefix is the prefix of the annotation that marks the
+// directive with the given index as having crashed the driver
+const crashedAnnotationPrefix = testerDomain + "crashed-"
+
+// exit terminates the process for the crash action
+var exit = os.Exit
+
+// resourceErrorRetryInterval is how long to wait before retrying a directive
+// that failed with an error that isn't fatal
+const resourceErrorRetryInterval = 10 * time.Second
+
 // WorkflowReconciler reconciles a Workflow object
 type WorkflowReconciler struct {
 	client.Client
 	Log    logr.Logger
 	Scheme *runtime.Scheme
+
+	// CopyRoots are the directories that the copy action may read from and
+	// write to. The copy action is disabled when this is empty.
+	CopyRoots []string
+
+	// EnableCrash allows the crash action to terminate the driver
+	EnableCrash bool
+
+	// StatusLatency delays writing updates to the driver status entries. A
+	// latency argument on a directive takes precedence.
+	StatusLatency Latency
+
+	// PopulateComputes has the driver fill the Computes resource of every
+	// workflow with tester directives in Proposal, rather than only those with
+	// a computes argument.
+	PopulateComputes bool
+
+	// ComputeNodes are the compute node names used to populate Computes
+	// resources. The compute nodes in the SystemConfiguration are used when
+	// this is empty.
+	ComputeNodes []string
+
+	// CapacitySeverity is the severity of the errors for storage directives
+	// that request more than the free capacity of the storage nodes
+	CapacitySeverity dwsv1alpha2.ResourceErrorSeverity
+
+	// Orphans checks for the children left behind by deleted workflows. No
+	// checks are made when this is nil.
+	Orphans *OrphanChecker
+
+	// TransferBandwidth is the bytes per second shared by the transfer
+	// actions of every workflow. The transfer action is disabled when this is
+	// zero.
+	TransferBandwidth int64
+
+	copies    *copyTracker
+	latencies *latencyTracker
+	ports     *portTracker
+	transfers *transferPool
 }
 
 //+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=workflows,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=workflows/finalizers,verbs=update
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=computes,verbs=get;list;watch;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=systemconfigurations,verbs=get;list;watch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=directivebreakdowns,verbs=get;list;watch;create;update;patch;delete;deletecollection
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=directivebreakdowns/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=servers,verbs=get;list;watch;create;update;patch;delete;deletecollection
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=persistentstorageinstances,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=persistentstorageinstances/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=dataworkflowservices.github.io,resources=storages,verbs=get;list;watch;update;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -60,11 +133,62 @@ func (r *WorkflowReconciler) Reconcile(ctx context.Context, req ctrl.Request) (r
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
-	// The workflow is being deleted. Nothing to do
+	// The workflow is being deleted. Stop anything running in the background
+	// on its behalf.
 	if !workflow.GetDeletionTimestamp().IsZero() {
+		r.copies.forget(workflow.GetUID())
+		r.latencies.forget(workflow.GetUID())
+		r.transfers.forget(workflow.GetUID(), time.Now())
+		r.releasePorts(workflow)
+		r.Orphans.schedule(workflow)
+
+		if !controllerutil.ContainsFinalizer(workflow, workflowFinalizer) {
+			return ctrl.Result{}, nil
+		}
+
+		behavior, err := workflowOnDelete(workflow)
+		if err != nil {
+			log.Error(err, "Could not parse ondelete argument, releasing workflow")
+		} else if reason, next := deletionHold(workflow, behavior); reason != "" {
+			log.Info("Holding workflow in deletion", "reason", reason)
+			return ctrl.Result{RequeueAfter: next}, nil
+		}
+
+		controllerutil.RemoveFinalizer(workflow, workflowFinalizer)
+		if err := r.Update(ctx, workflow); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+
+		log.Info("Removed finalizer")
+		return ctrl.Result{}, nil
+	}
+
+	// Hold on to workflows with tester directives so that their deletion can
+	// be delayed or blocked by an ondelete argument
+	if hasTesterDirectives(workflow) && !controllerutil.ContainsFinalizer(workflow, workflowFinalizer) {
+		controllerutil.AddFinalizer(workflow, workflowFinalizer)
+		if err := r.Update(ctx, workflow); err != nil {
+			return ctrl.Result{}, client.IgnoreNotFound(err)
+		}
+
 		return ctrl.Result{}, nil
 	}
 
+	// Ports are held for the life of the workflow, up to Teardown
+	if workflow.Spec.DesiredState == dwsv1alpha2.StateTeardown {
+		r.releasePorts(workflow)
+	}
+
+	// The WLM is hurrying the workflow through teardown. Any data movement
+	// that's still running is abandoned.
+	if workflow.Spec.Hurry {
+		r.copies.cancel(workflow.GetUID())
+	}
+
+	// Transfers that were cut short by a change of state no longer take a
+	// share of the bandwidth
+	r.transfers.abandon(workflow.GetUID(), workflow.Spec.DesiredState, time.Now())
+
 	// Nothing to do
 	if workflow.Status.Ready {
 		return ctrl.Result{}, nil
@@ -83,7 +207,16 @@ func (r *WorkflowReconciler) Reconcile(ctx context.Context, req ctrl.Request) (r
 	// in workflow.Status{} change. This is necessary since Status is not a subresource
 	// of the workflow.
 	statusUpdater := updater.NewStatusUpdater[*dwsv1alpha2.WorkflowStatus](workflow)
-	defer func() { err = statusUpdater.CloseWithUpdate(ctx, r, err) }()
+	original := workflow.Status.DeepCopy()
+	defer func() {
+		r.delayStatusUpdate(workflow, original, &res)
+		err = statusUpdater.CloseWithUpdate(ctx, r, err)
+	}()
+
+	// The failure of the storage nodes holding the workflow's storage, looked
+	// up the first time it's needed
+	var failure *dwsv1alpha2.ResourceErrorInfo
+	failureChecked := false
 
 	// Check workflow for test driver entries
 	for driverStatusIndex, driverStatus := range workflow.Status.Drivers {
@@ -115,13 +248,90 @@ func (r *WorkflowReconciler) Reconcile(ctx context.Context, req ctrl.Request) (r
 			return ctrl.Result{}, err
 		}
 
+		if value, found := args["latency"]; found {
+			if _, err := ParseLatency(value); err != nil {
+				setDriverError(&driverStatus, dwsv1alpha2.NewResourceError("").WithError(err).
+					WithUserMessage("invalid 'latency' argument '%s'", value).WithUser().WithFatal())
+				workflow.Status.Drivers[driverStatusIndex] = driverStatus
+				continue
+			}
+		}
+
+		// Hold the entry until the directives that it depends on have completed
+		if after, found := args["after"]; found {
+			pending, resErr := dependenciesPending(workflow, driverStatus, after)
+			if resErr != nil {
+				setDriverError(&driverStatus, resErr)
+				workflow.Status.Drivers[driverStatusIndex] = driverStatus
+				continue
+			}
+
+			if len(pending) > 0 {
+				log.Info("Driver waiting on directives", "index", driverStatus.DWDIndex, "after", pending)
+				driverStatus.Message = "Waiting on directives: " + joinIndices(pending)
+				workflow.Status.Drivers[driverStatusIndex] = driverStatus
+				continue
+			}
+
+			driverStatus.Message = ""
+		}
+
+		// Play the part of the WLM by assigning compute nodes to the workflow
+		if desiredState == dwsv1alpha2.StateProposal && r.assignsComputes(args) {
+			populated, err := r.populateComputes(ctx, workflow, args)
+			if resErr, ok := err.(*dwsv1alpha2.ResourceErrorInfo); ok {
+				log.Info("Could not populate Computes", "error", resErr.Error())
+				setDriverError(&driverStatus, resErr)
+				if resErr.Severity != dwsv1alpha2.SeverityFatal {
+					requeueAfter(&res, resourceErrorRetryInterval)
+				}
+				workflow.Status.Drivers[driverStatusIndex] = driverStatus
+				continue
+			}
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+
+			// Wait for DWS to create the Computes resource
+			if !populated {
+				continue
+			}
+		}
+
+		// Entries can't make progress while the workflow's storage is on an
+		// unhealthy storage node
+		if checksStorageHealth(desiredState) && args["action"] != "fail-storage" {
+			if !failureChecked {
+				if failure, err = storageFailure(ctx, r.Client, workflow); err != nil {
+					return ctrl.Result{}, err
+				}
+				failureChecked = true
+			}
+
+			if failure != nil {
+				log.Info("Storage failure", "index", driverStatus.DWDIndex, "error", failure.Error())
+				setDriverError(&driverStatus, failure)
+				if failure.Severity != dwsv1alpha2.SeverityFatal {
+					requeueAfter(&res, resourceErrorRetryInterval)
+				}
+				workflow.Status.Drivers[driverStatusIndex] = driverStatus
+				continue
+			}
+		}
+
 		switch {
+		case isStorageCommand(args["command"]):
+			done, err := r.storageDirective(ctx, workflow, &driverStatus, args)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if !done {
+				requeueAfter(&res, storageRequeueInterval(&driverStatus))
+			}
+
 		case args["action"] == "complete":
 			log.Info("Completing workflow")
-			driverStatus.Completed = true
-			driverStatus.Status = dwsv1alpha2.StatusCompleted
-			ct := metav1.NowMicro()
-			driverStatus.CompleteTime = &ct
+			completeDriverStatus(&driverStatus)
 		case args["action"] == "wait":
 			// The driver status will be marked complete by external process
 			// Nothing to do
@@ -129,26 +339,44 @@ func (r *WorkflowReconciler) Reconcile(ctx context.Context, req ctrl.Request) (r
 			continue
 		case args["action"] == "error":
 			log.Info("Failing workflow")
-			driverStatus.Message = "Reported error: " + args["message"]
-			// Errors are found on the #DW line with
-			// underscores representing spaces, which allows the
-			// #DW parser to be simple; the controller will swap
-			// those back to spaces.
-			driverStatus.Error = strings.ReplaceAll(args["message"], "_", " ")
-
-			var severity string
-			var present bool
-			severity, present = args["severity"]
-			if !present {
-				severity = ""
-			}
-			status, err := dwsv1alpha2.SeverityStringToStatus(severity)
+			errorAction(&driverStatus, args)
+
+		case args["action"] == "copy":
+			if next := r.copyAction(workflow, &driverStatus, args); next > 0 {
+				requeueAfter(&res, next)
+			}
+
+		case args["action"] == "transfer":
+			if next := r.transferAction(workflow, &driverStatus, args); next > 0 {
+				requeueAfter(&res, next)
+			}
+
+		case args["action"] == "flap":
+			if next := flapAction(workflow, &driverStatus, args); next > 0 {
+				requeueAfter(&res, next)
+			}
+
+		case args["action"] == "port":
+			next, err := r.portAction(ctx, workflow, &driverStatus, args)
 			if err != nil {
-				driverStatus.Status = dwsv1alpha2.StatusError
-				driverStatus.Message = "Internal error: " + err.Error()
-				driverStatus.Error = err.Error()
-			} else {
-				driverStatus.Status = status
+				return ctrl.Result{}, err
+			}
+			if next > 0 {
+				requeueAfter(&res, next)
+			}
+
+		case args["action"] == "fail-storage":
+			next, err := r.failStorageAction(ctx, workflow, &driverStatus, args)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if next > 0 {
+				requeueAfter(&res, next)
+			}
+
+		case args["action"] == "crash":
+			if err := r.crashAction(ctx, workflow, &driverStatus); err != nil {
+				return ctrl.Result{}, err
 			}
 
 		default:
@@ -159,12 +387,428 @@ func (r *WorkflowReconciler) Reconcile(ctx context.Context, req ctrl.Request) (r
 		workflow.Status.Drivers[driverStatusIndex] = driverStatus
 	}
 
-	return ctrl.Result{}, nil
+	return res, nil
+}
+
+// copyAction copies the directory tree named by the src argument to the dst
+// argument. The copy runs in the background and the driver status reports its
+// progress until it finishes. A copy that fails with an error that isn't fatal
+// is started over. Returns the time until the driver status should be looked
+// at again, or zero once it has reached a final result.
+func (r *WorkflowReconciler) copyAction(workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) time.Duration {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow), "index", driverStatus.DWDIndex)
+
+	job := r.copies.get(workflow.GetUID(), driverStatus.DWDIndex)
+	if job == nil {
+		if resErr := validateCopyPaths(args["src"], args["dst"], r.CopyRoots); resErr != nil {
+			setDriverError(driverStatus, resErr)
+			return 0
+		}
+
+		log.Info("Starting copy", "src", args["src"], "dst", args["dst"])
+		job = r.copies.start(workflow.GetUID(), driverStatus.DWDIndex, args["src"], args["dst"])
+	}
+
+	done, err := job.finished()
+	if !done {
+		if job.reportDue(time.Now()) || driverStatus.Status != dwsv1alpha2.StatusRunning {
+			driverStatus.Status = dwsv1alpha2.StatusRunning
+			driverStatus.Message = "Copying: " + job.progress()
+		}
+		return copyProgressInterval
+	}
+
+	// A copy cancelled by the WLM hurrying the workflow through Teardown was
+	// abandoned rather than failed, so its entry is left as it is
+	if errors.Is(err, context.Canceled) {
+		log.Info("Copy abandoned", "progress", job.progress())
+		r.copies.remove(workflow.GetUID(), driverStatus.DWDIndex)
+		return 0
+	}
+
+	if err != nil {
+		log.Info("Copy failed", "error", err.Error())
+		resErr := copyError(err)
+		setDriverError(driverStatus, resErr)
+		if resErr.Severity == dwsv1alpha2.SeverityFatal {
+			return 0
+		}
+
+		// Start the copy over on the next attempt
+		r.copies.remove(workflow.GetUID(), driverStatus.DWDIndex)
+		return resourceErrorRetryInterval
+	}
+
+	log.Info("Copy complete", "progress", job.progress())
+	completeDriverStatus(driverStatus)
+	driverStatus.Message = "Copied " + job.progress()
+
+	return 0
+}
+
+// errorAction records the error given by the message and severity arguments
+func errorAction(driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) {
+	driverStatus.Message = "Reported error: " + args["message"]
+	// Errors are found on the #DW line with
+	// underscores representing spaces, which allows the
+	// #DW parser to be simple; the controller will swap
+	// those back to spaces.
+	driverStatus.Error = strings.ReplaceAll(args["message"], "_", " ")
+
+	var severity string
+	var present bool
+	severity, present = args["severity"]
+	if !present {
+		severity = ""
+	}
+	status, err := dwsv1alpha2.SeverityStringToStatus(severity)
+	if err != nil {
+		driverStatus.Status = dwsv1alpha2.StatusError
+		driverStatus.Message = "Internal error: " + err.Error()
+		driverStatus.Error = err.Error()
+	} else {
+		driverStatus.Status = status
+	}
+}
+
+// Defaults for the flap action
+const (
+	defaultFlapCycles = 3
+	defaultFlapPeriod = 10 * time.Second
+)
+
+// flapAction alternates the driver status between Running and
+// TransientCondition. Each cycle spends one period in each status, with a
+// message that names the cycle. After the number of cycles given by the cycles
+// argument the directive either completes or reports the error given by the
+// message and severity arguments, as chosen by the final argument. The cycles
+// are timed from the start of the state so that a restarted driver picks up
+// where it left off. Returns the time until the next change in status, or zero
+// once the final status has been reached.
+func flapAction(workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) time.Duration {
+	cycles := defaultFlapCycles
+	if value, found := args["cycles"]; found {
+		var err error
+		if cycles, err = strconv.Atoi(value); err != nil || cycles < 1 {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("invalid cycles '%s'", value).
+				WithUserMessage("invalid 'cycles' argument '%s'", value).WithUser().WithFatal())
+			return 0
+		}
+	}
+
+	period := defaultFlapPeriod
+	if value, found := args["period"]; found {
+		var err error
+		if period, err = time.ParseDuration(value); err != nil || period <= 0 {
+			setDriverError(driverStatus, dwsv1alpha2.NewResourceError("invalid period '%s'", value).
+				WithUserMessage("invalid 'period' argument '%s'", value).WithUser().WithFatal())
+			return 0
+		}
+	}
+
+	final := args["final"]
+	if final != "" && final != "complete" && final != "error" {
+		setDriverError(driverStatus, dwsv1alpha2.NewResourceError("invalid final '%s'", final).
+			WithUserMessage("invalid 'final' argument '%s'", final).WithUser().WithFatal())
+		return 0
+	}
+
+	start := time.Now()
+	if workflow.Status.DesiredStateChange != nil {
+		start = workflow.Status.DesiredStateChange.Time
+	}
+
+	elapsed := time.Since(start)
+	phase := int(elapsed / period)
+	if phase >= 2*cycles {
+		if final == "error" {
+			errorAction(driverStatus, args)
+		} else {
+			completeDriverStatus(driverStatus)
+		}
+
+		return 0
+	}
+
+	cycle := phase/2 + 1
+	if phase%2 == 0 {
+		driverStatus.Status = dwsv1alpha2.StatusRunning
+		driverStatus.Message = fmt.Sprintf("Flap cycle %d of %d: running", cycle, cycles)
+		driverStatus.Error = ""
+	} else {
+		driverStatus.Status = dwsv1alpha2.StatusTransientCondition
+		driverStatus.Message = fmt.Sprintf("Flap cycle %d of %d: transient condition", cycle, cycles)
+		driverStatus.Error = fmt.Sprintf("simulated transient condition %d of %d", cycle, cycles)
+	}
+
+	return time.Duration(phase+1)*period - elapsed
+}
+
+// delayStatusUpdate holds back the driver status entries if any of the tester
+// entries have changed since the workflow was read. The longest of the
+// latencies picked for the changed entries is used. Until the delay has passed
+// the status is left as it was read and the workflow is queued again for when
+// the update is due, so that other workflows aren't held up in the meantime.
+func (r *WorkflowReconciler) delayStatusUpdate(workflow *dwsv1alpha2.Workflow, original *dwsv1alpha2.WorkflowStatus, res *ctrl.Result) {
+	delay := time.Duration(0)
+	for i, driverStatus := range workflow.Status.Drivers {
+		if driverStatus.DriverID != DRIVERID || reflect.DeepEqual(driverStatus, original.Drivers[i]) {
+			continue
+		}
+
+		latency := r.StatusLatency
+		if args, err := dwdparse.BuildArgsMap(workflow.Spec.DWDirectives[driverStatus.DWDIndex]); err == nil {
+			if value, found := args["latency"]; found {
+				if l, err := ParseLatency(value); err == nil {
+					latency = l
+				}
+			}
+		}
+
+		if d := latency.Pick(); d > delay {
+			delay = d
+		}
+	}
+
+	if delay == 0 {
+		r.latencies.forget(workflow.GetUID())
+		return
+	}
+
+	remaining := r.latencies.hold(workflow.GetUID(), delay, time.Now())
+	if remaining <= 0 {
+		return
+	}
+
+	r.Log.Info("Delaying status update", "Workflow", client.ObjectKeyFromObject(workflow), "delay", remaining.String())
+
+	workflow.Status = *original.DeepCopy()
+	requeueAfter(res, remaining)
+}
+
+// crashAction terminates the driver the first time the directive is seen. A
+// marker annotation is saved on the workflow before exiting so that the
+// restarted driver completes the directive rather than crashing again. The
+// driver status of any directives handled before the crash is saved along with
+// the marker.
+func (r *WorkflowReconciler) crashAction(ctx context.Context, workflow *dwsv1alpha2.Workflow, driverStatus *dwsv1alpha2.WorkflowDriverStatus) error {
+	log := r.Log.WithValues("Workflow", client.ObjectKeyFromObject(workflow), "index", driverStatus.DWDIndex)
+
+	if !r.EnableCrash {
+		setDriverError(driverStatus, dwsv1alpha2.NewResourceError("crash action is disabled").
+			WithUserMessage("crash action is not enabled in the driver").WithUser().WithFatal())
+		return nil
+	}
+
+	marker := crashedAnnotationPrefix + strconv.Itoa(driverStatus.DWDIndex)
+	if _, found := workflow.GetAnnotations()[marker]; found {
+		log.Info("Completing directive after crash")
+		completeDriverStatus(driverStatus)
+		return nil
+	}
+
+	annotations := workflow.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[marker] = string(driverStatus.WatchState)
+	workflow.SetAnnotations(annotations)
+
+	if err := r.Update(ctx, workflow); err != nil {
+		return err
+	}
+
+	log.Info("Crashing driver", "state", driverStatus.WatchState)
+	exit(1)
+
+	return nil
+}
+
+// releasePorts releases the ports allocated to a workflow
+func (r *WorkflowReconciler) releasePorts(workflow *dwsv1alpha2.Workflow) {
+	if ports := r.ports.release(workflow.GetUID()); len(ports) > 0 {
+		r.Log.Info("Released ports", "Workflow", client.ObjectKeyFromObject(workflow), "ports", ports)
+	}
+}
+
+// parseIndices parses a comma separated list of directive indices.
+func parseIndices(value string) ([]int, error) {
+	indices := []int{}
+	for _, field := range strings.Split(value, ",") {
+		index, err := strconv.Atoi(field)
+		if err != nil || index < 0 {
+			return nil, fmt.Errorf("invalid directive index '%s'", field)
+		}
+
+		indices = append(indices, index)
+	}
+
+	return indices, nil
+}
+
+// joinIndices formats a list of directive indices as a comma separated list.
+func joinIndices(indices []int) string {
+	fields := make([]string, len(indices))
+	for i, index := range indices {
+		fields[i] = strconv.Itoa(index)
+	}
+
+	return strings.Join(fields, ",")
+}
+
+// dependenciesPending returns the directive indices in the after argument
+// whose driver status entries for the current state haven't completed. The
+// entries may belong to any driver. A dependency that can never complete,
+// either because it has no entry in this state or because it is part of a
+// cycle, is returned as an error.
+func dependenciesPending(workflow *dwsv1alpha2.Workflow, driverStatus dwsv1alpha2.WorkflowDriverStatus, after string) ([]int, *dwsv1alpha2.ResourceErrorInfo) {
+	dependencies, err := parseIndices(after)
+	if err != nil {
+		return nil, dwsv1alpha2.NewResourceError("").WithError(err).
+			WithUserMessage("invalid 'after' argument '%s'", after).WithUser().WithFatal()
+	}
+
+	if cycle := dependencyCycle(workflow, driverStatus.WatchState, driverStatus.DWDIndex); cycle != nil {
+		return nil, dwsv1alpha2.NewResourceError("dependency cycle between directives: %s", joinIndices(cycle)).
+			WithUserMessage("directive %d depends on itself", driverStatus.DWDIndex).WithUser().WithFatal()
+	}
+
+	pending := []int{}
+	for _, dependency := range dependencies {
+		found := false
+		for _, other := range workflow.Status.Drivers {
+			if other.DWDIndex != dependency || other.WatchState != driverStatus.WatchState {
+				continue
+			}
+
+			found = true
+			if !other.Completed {
+				pending = append(pending, dependency)
+				break
+			}
+		}
+
+		if !found {
+			return nil, dwsv1alpha2.NewResourceError("directive %d has no driver in state %s", dependency, driverStatus.WatchState).
+				WithUserMessage("invalid 'after' argument '%s'", after).WithUser().WithFatal()
+		}
+	}
+
+	return pending, nil
+}
+
+// dependencyCycle follows the 'after' arguments of the tester directives in a
+// state, starting from the directive at index. Returns the directive indices
+// that lead back to the starting directive, or nil if there is no cycle.
+// Directives of other drivers can't depend on tester directives, so only the
+// tester directives need to be followed.
+func dependencyCycle(workflow *dwsv1alpha2.Workflow, state dwsv1alpha2.WorkflowState, index int) []int {
+	dependsOn := func(index int) []int {
+		for _, driverStatus := range workflow.Status.Drivers {
+			if driverStatus.DriverID != DRIVERID || driverStatus.WatchState != state || driverStatus.DWDIndex != index {
+				continue
+			}
+
+			args, err := dwdparse.BuildArgsMap(workflow.Spec.DWDirectives[index])
+			if err != nil {
+				return nil
+			}
+
+			if after, found := args["after"]; found {
+				dependencies, _ := parseIndices(after)
+				return dependencies
+			}
+		}
+
+		return nil
+	}
+
+	visited := map[int]bool{}
+	var walk func(current int, path []int) []int
+	walk = func(current int, path []int) []int {
+		for _, next := range dependsOn(current) {
+			if next == index {
+				return append(path, next)
+			}
+
+			if visited[next] {
+				continue
+			}
+			visited[next] = true
+
+			if cycle := walk(next, append(path, next)); cycle != nil {
+				return cycle
+			}
+		}
+
+		return nil
+	}
+
+	return walk(index, []int{index})
+}
+
+// completeDriverStatus marks the driver status entry as complete
+func completeDriverStatus(driverStatus *dwsv1alpha2.WorkflowDriverStatus) {
+	driverStatus.Completed = true
+	driverStatus.Status = dwsv1alpha2.StatusCompleted
+	driverStatus.Message = ""
+	driverStatus.Error = ""
+	ct := metav1.NowMicro()
+	driverStatus.CompleteTime = &ct
+}
+
+// setDriverError records a resource error in the driver status entry. The
+// status of the entry is chosen from the severity of the error.
+func setDriverError(driverStatus *dwsv1alpha2.WorkflowDriverStatus, resErr *dwsv1alpha2.ResourceErrorInfo) {
+	status, err := resErr.Severity.ToStatus()
+	if err != nil {
+		status = dwsv1alpha2.StatusError
+	}
+
+	driverStatus.Status = status
+	driverStatus.Error = resErr.Error()
+	if resErr.UserMessage != "" {
+		driverStatus.Message = resErr.GetUserMessage()
+	} else {
+		driverStatus.Message = resErr.Error()
+	}
+}
+
+// ParseSeverity parses the severity of a resource error, ignoring case. An
+// empty severity is Minor.
+func ParseSeverity(severity string) (dwsv1alpha2.ResourceErrorSeverity, error) {
+	switch strings.ToLower(severity) {
+	case "", "minor":
+		return dwsv1alpha2.SeverityMinor, nil
+	case "major":
+		return dwsv1alpha2.SeverityMajor, nil
+	case "fatal":
+		return dwsv1alpha2.SeverityFatal, nil
+	}
+
+	return "", fmt.Errorf("unknown severity: %s", severity)
+}
+
+// requeueAfter shortens the requeue time of the result to d, unless the
+// result is already set to requeue sooner.
+func requeueAfter(res *ctrl.Result, d time.Duration) {
+	if res.RequeueAfter == 0 || d < res.RequeueAfter {
+		res.RequeueAfter = d
+	}
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *WorkflowReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.copies = newCopyTracker()
+	r.latencies = newLatencyTracker()
+	r.ports = newPortTracker()
+	r.transfers = newTransferPool(r.TransferBandwidth)
+
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&dwsv1alpha2.Workflow{}).
+		Watches(&dwsv1alpha2.Servers{}, handler.EnqueueRequestsFromMapFunc(workflowLabelMapFunc),
+			builder.WithPredicates(predicate.NewPredicateFuncs(isDriverResource))).
+		Watches(&dwsv1alpha2.Storage{}, handler.EnqueueRequestsFromMapFunc(r.storageMapFunc),
+			builder.WithPredicates(predicate.NewPredicateFuncs(isDriverResource))).
 		Complete(r)
 }
@@ -1,5 +1,5 @@
 /*
-Copyright 2022-2023 Hewlett Packard Enterprise Development LP.
+Copyright 2022-2024 Hewlett Packard Enterprise Development LP.
 
 Licensed under the Apache License, Version 2.0 (the "License");
 you may not use this file except in compliance with the License.
@@ -21,6 +21,7 @@ import (
 	"fmt"
 	"reflect"
 	"strings"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/uuid"
@@ -30,6 +31,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
 
 	dwsv1alpha2 "github.com/DataWorkflowServices/dws/api/v1alpha2"
 )
@@ -166,4 +169,296 @@ var _ = Describe("Workflow Controller Test", func() {
 			expectedDriverStatus,
 		}
 	})
+
+	DescribeTable("Settles flapping Workflow driver states after their cycles",
+		func(final string, expectedDriverStatus dwsv1alpha2.WorkflowDriverStatus) {
+			wf.Spec.DWDirectives = []string{
+				"#DW Proposal action=flap cycles=2 period=100ms final=" + final + " message=flapped severity=Fatal",
+			}
+
+			expectedDriverStatus.DriverID = DRIVERID
+			expectedDriverStatus.DWDIndex = 0
+			expectedDriverStatus.WatchState = dwsv1alpha2.StateProposal
+
+			expectedDriverStatuses = []dwsv1alpha2.WorkflowDriverStatus{
+				expectedDriverStatus,
+			}
+		},
+		Entry("by completing", "complete", dwsv1alpha2.WorkflowDriverStatus{
+			Status:       dwsv1alpha2.StatusCompleted,
+			Completed:    true,
+			CompleteTime: &metav1.MicroTime{},
+		}),
+		Entry("with an error", "error", dwsv1alpha2.WorkflowDriverStatus{
+			Status:  dwsv1alpha2.StatusError,
+			Message: "Reported error: flapped",
+			Error:   "flapped",
+		}),
+	)
+
+	It("Refuses to crash when the crash action is disabled", func() {
+		wf.Spec.DWDirectives = []string{
+			"#DW Proposal action=crash",
+		}
+
+		resErr := dwsv1alpha2.NewResourceError("crash action is disabled").
+			WithUserMessage("crash action is not enabled in the driver").WithUser().WithFatal()
+		expectedDriverStatuses = []dwsv1alpha2.WorkflowDriverStatus{
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   0,
+				WatchState: dwsv1alpha2.StateProposal,
+				Status:     dwsv1alpha2.StatusError,
+				Message:    resErr.GetUserMessage(),
+				Error:      resErr.Error(),
+			},
+		}
+	})
+
+	It("Completes Workflow driver states after the directives they depend on", func() {
+		wf.Spec.DWDirectives = []string{
+			"#DW Proposal action=complete after=1",
+			"#DW Proposal action=complete",
+		}
+
+		aTimeWasSet := metav1.NowMicro()
+		expectedDriverStatuses = []dwsv1alpha2.WorkflowDriverStatus{
+			{
+				DriverID:     DRIVERID,
+				DWDIndex:     0,
+				WatchState:   dwsv1alpha2.StateProposal,
+				Status:       dwsv1alpha2.StatusCompleted,
+				Completed:    true,
+				CompleteTime: &aTimeWasSet,
+			},
+			{
+				DriverID:     DRIVERID,
+				DWDIndex:     1,
+				WatchState:   dwsv1alpha2.StateProposal,
+				Status:       dwsv1alpha2.StatusCompleted,
+				Completed:    true,
+				CompleteTime: &aTimeWasSet,
+			},
+		}
+	})
+
+	It("Holds Workflow driver states until the directives they depend on complete", func() {
+		wf.Spec.DWDirectives = []string{
+			"#DW Proposal action=complete after=1",
+			"#DW Proposal action=wait",
+		}
+
+		expectedDriverStatuses = []dwsv1alpha2.WorkflowDriverStatus{
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   0,
+				WatchState: dwsv1alpha2.StateProposal,
+				Status:     dwsv1alpha2.StatusPending,
+				Message:    "Waiting on directives: 1",
+			},
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   1,
+				WatchState: dwsv1alpha2.StateProposal,
+				Status:     dwsv1alpha2.StatusPending,
+			},
+		}
+	})
+
+	It("Fails Workflow driver states that depend on themselves", func() {
+		wf.Spec.DWDirectives = []string{
+			"#DW Proposal action=complete after=1",
+			"#DW Proposal action=complete after=0",
+		}
+
+		resErr := dwsv1alpha2.NewResourceError("dependency cycle between directives: 0,1,0").
+			WithUserMessage("directive 0 depends on itself").WithUser().WithFatal()
+		otherErr := dwsv1alpha2.NewResourceError("dependency cycle between directives: 1,0,1").
+			WithUserMessage("directive 1 depends on itself").WithUser().WithFatal()
+		expectedDriverStatuses = []dwsv1alpha2.WorkflowDriverStatus{
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   0,
+				WatchState: dwsv1alpha2.StateProposal,
+				Status:     dwsv1alpha2.StatusError,
+				Message:    resErr.GetUserMessage(),
+				Error:      resErr.Error(),
+			},
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   1,
+				WatchState: dwsv1alpha2.StateProposal,
+				Status:     dwsv1alpha2.StatusError,
+				Message:    otherErr.GetUserMessage(),
+				Error:      otherErr.Error(),
+			},
+		}
+	})
+	It("Completes the Proposal of storage directives", func() {
+		wf.Spec.DWDirectives = []string{
+			"#DW jobdw type=xfs capacity=1GiB name=scratch",
+		}
+
+		aTimeWasSet := metav1.NowMicro()
+		expectedDriverStatuses = []dwsv1alpha2.WorkflowDriverStatus{
+			{
+				DriverID:     DRIVERID,
+				DWDIndex:     0,
+				WatchState:   dwsv1alpha2.StateProposal,
+				Status:       dwsv1alpha2.StatusCompleted,
+				Completed:    true,
+				CompleteTime: &aTimeWasSet,
+			},
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   0,
+				WatchState: dwsv1alpha2.StateSetup,
+				Status:     dwsv1alpha2.StatusPending,
+			},
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   0,
+				WatchState: dwsv1alpha2.StateTeardown,
+				Status:     dwsv1alpha2.StatusPending,
+			},
+		}
+	})
+	It("Fails to use persistent storage that doesn't exist", func() {
+		wf.Spec.DWDirectives = []string{
+			"#DW persistentdw name=missing",
+		}
+
+		resErr := dwsv1alpha2.NewResourceError("persistent storage instance 'missing' not found").
+			WithUserMessage("persistent storage 'missing' not found").WithUser().WithFatal()
+		expectedDriverStatuses = []dwsv1alpha2.WorkflowDriverStatus{
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   0,
+				WatchState: dwsv1alpha2.StateProposal,
+				Status:     dwsv1alpha2.StatusError,
+				Message:    resErr.GetUserMessage(),
+				Error:      resErr.Error(),
+			},
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   0,
+				WatchState: dwsv1alpha2.StateSetup,
+				Status:     dwsv1alpha2.StatusPending,
+			},
+			{
+				DriverID:   DRIVERID,
+				DWDIndex:   0,
+				WatchState: dwsv1alpha2.StateTeardown,
+				Status:     dwsv1alpha2.StatusPending,
+			},
+		}
+	})
+})
+
+var _ = Describe("Flap Action Test", func() {
+
+	// flapAt runs the flap action as it would be seen the given time after
+	// the start of the state
+	flapAt := func(elapsed time.Duration, driverStatus *dwsv1alpha2.WorkflowDriverStatus, args map[string]string) time.Duration {
+		start := metav1.NewMicroTime(time.Now().Add(-elapsed))
+		workflow := &dwsv1alpha2.Workflow{Status: dwsv1alpha2.WorkflowStatus{DesiredStateChange: &start}}
+
+		return flapAction(workflow, driverStatus, args)
+	}
+
+	It("Alternates between Running and TransientCondition before completing", func() {
+		args := map[string]string{"cycles": "2", "period": "1m"}
+		driverStatus := &dwsv1alpha2.WorkflowDriverStatus{WatchState: dwsv1alpha2.StatePreRun}
+
+		expected := []struct {
+			status  string
+			message string
+		}{
+			{dwsv1alpha2.StatusRunning, "Flap cycle 1 of 2: running"},
+			{dwsv1alpha2.StatusTransientCondition, "Flap cycle 1 of 2: transient condition"},
+			{dwsv1alpha2.StatusRunning, "Flap cycle 2 of 2: running"},
+			{dwsv1alpha2.StatusTransientCondition, "Flap cycle 2 of 2: transient condition"},
+		}
+
+		for phase, e := range expected {
+			next := flapAt(time.Duration(phase)*time.Minute+30*time.Second, driverStatus, args)
+			Expect(next).To(BeNumerically("~", 30*time.Second, time.Second))
+			Expect(driverStatus.Status).To(Equal(e.status))
+			Expect(driverStatus.Message).To(Equal(e.message))
+			Expect(driverStatus.Completed).To(BeFalse())
+		}
+
+		Expect(flapAt(4*time.Minute+30*time.Second, driverStatus, args)).To(BeZero())
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusCompleted))
+		Expect(driverStatus.Completed).To(BeTrue())
+	})
+
+	It("Reports the final error after the configured number of flaps", func() {
+		args := map[string]string{"cycles": "1", "period": "1m", "final": "error", "message": "flapped", "severity": "Fatal"}
+		driverStatus := &dwsv1alpha2.WorkflowDriverStatus{WatchState: dwsv1alpha2.StatePreRun}
+
+		flapAt(90*time.Second, driverStatus, args)
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusTransientCondition))
+
+		Expect(flapAt(2*time.Minute, driverStatus, args)).To(BeZero())
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusError))
+		Expect(driverStatus.Error).To(Equal("flapped"))
+	})
+})
+
+// updateRecorder is a client that records the workflows it is asked to update
+type updateRecorder struct {
+	client.Client
+	updates []*dwsv1alpha2.Workflow
+}
+
+func (c *updateRecorder) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	c.updates = append(c.updates, obj.(*dwsv1alpha2.Workflow).DeepCopy())
+	return nil
+}
+
+var _ = Describe("Crash Action Test", func() {
+
+	var (
+		r        *WorkflowReconciler
+		recorder *updateRecorder
+		exits    []int
+	)
+
+	BeforeEach(func() {
+		recorder = &updateRecorder{}
+		r = &WorkflowReconciler{
+			Client:      recorder,
+			Log:         ctrl.Log.WithName("controllers").WithName("test-crash"),
+			EnableCrash: true,
+		}
+
+		exits = []int{}
+		DeferCleanup(func(original func(int)) { exit = original }, exit)
+	})
+
+	It("Saves the crash marker before exiting and completes the directive after the restart", func() {
+		workflow := &dwsv1alpha2.Workflow{}
+		driverStatus := &dwsv1alpha2.WorkflowDriverStatus{DWDIndex: 1, WatchState: dwsv1alpha2.StateDataIn}
+		marker := crashedAnnotationPrefix + "1"
+
+		exit = func(code int) {
+			// The marker must already be saved when the driver goes down
+			Expect(recorder.updates).To(HaveLen(1))
+			Expect(recorder.updates[0].GetAnnotations()).To(HaveKeyWithValue(marker, string(dwsv1alpha2.StateDataIn)))
+			exits = append(exits, code)
+		}
+
+		Expect(r.crashAction(context.TODO(), workflow, driverStatus)).To(Succeed())
+		Expect(exits).To(Equal([]int{1}))
+		Expect(driverStatus.Completed).To(BeFalse())
+
+		// The restarted driver reads the workflow with the marker
+		workflow = recorder.updates[0]
+		Expect(r.crashAction(context.TODO(), workflow, driverStatus)).To(Succeed())
+		Expect(exits).To(Equal([]int{1}))
+		Expect(recorder.updates).To(HaveLen(1))
+		Expect(driverStatus.Status).To(Equal(dwsv1alpha2.StatusCompleted))
+		Expect(driverStatus.Completed).To(BeTrue())
+	})
 })